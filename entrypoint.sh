@@ -2,39 +2,9 @@
 
 set -e
 
-mkdir -p /tmp/coredock
-NAMESERVERS=${COREDOCK_NAMESERVERS:-""}
+ZONE_DIR=${COREDOCK_ZONE_DIR:-/tmp/coredock}
 
-nameservers="${NAMESERVERS//,/ }"
-fanout=""
-
-fanout="fanout . 127.0.0.1:5311"
-if [ -n "$nameservers" ]; then
-    fanout="fanout . ${nameservers}"
-fi
-
-
-corefile="
-. {
-    auto {
-        directory /tmp/coredock/
-        reload 1s
-    }
-    loadbalance
-}
-"
-
-corefileforward="
-. {
-    log
-    ${fanout} {
-      timeout 300ms
-  }
-}
-"
-
-echo "$corefile" > /tmp/coredock/Corefile
-echo "$corefileforward" > /tmp/coredock/Corefile.forward
-./coredns -dns.port 5311 -p 5311 --conf /tmp/coredock/Corefile &
-./coredns --conf /tmp/coredock/Corefile.forward &
+./coredock corefile
+./coredns -dns.port 5311 -p 5311 --conf "$ZONE_DIR/Corefile" &
+./coredns --conf "$ZONE_DIR/Corefile.forward" &
 ./coredock
@@ -2,14 +2,17 @@ module github.com/ad-on-is/coredock
 
 go 1.25.2
 
-require github.com/fsouza/go-dockerclient v1.12.2
+require (
+	github.com/fsouza/go-dockerclient v1.12.2
+	go.etcd.io/bbolt v1.4.3
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/cenkalti/backoff/v5 v5.0.3 // indirect
 	github.com/golang-queue/queue v0.4.0 // indirect
 	github.com/jpillora/backoff v1.0.0 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
-	go.etcd.io/bbolt v1.4.3 // indirect
 )
 
 require (
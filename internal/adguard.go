@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thoas/go-funk"
+)
+
+type adguardRewrite struct {
+	Domain string `json:"domain"`
+	Answer string `json:"answer"`
+}
+
+func (r adguardRewrite) String() string {
+	return r.Domain + " " + r.Answer
+}
+
+// AdGuardSink keeps the DNS rewrites of an AdGuard Home instance in sync.
+// Rewrites that were not created by coredock are never touched. Like the
+// DynamicUpdater, rewrites are synced in the background.
+type AdGuardSink struct {
+	config  *Config
+	db      *DB
+	client  *http.Client
+	pending map[string]adguardRewrite
+	wake    chan struct{}
+	mux     sync.Mutex
+}
+
+func NewAdGuardSink(config *Config, db *DB) *AdGuardSink {
+	return &AdGuardSink{config: config, db: db, client: &http.Client{Timeout: 10 * time.Second}, wake: make(chan struct{}, 1)}
+}
+
+func (a *AdGuardSink) Name() string {
+	return "adguard"
+}
+
+func (a *AdGuardSink) Write(set *RecordSet) error {
+	if a.config.AdGuardURL == "" {
+		return fmt.Errorf("COREDOCK_ADGUARD_URL is not set")
+	}
+
+	desired := map[string]adguardRewrite{}
+	for _, rr := range set.ForwardRecords() {
+		name := strings.TrimSuffix(rr.Header().Name, ".")
+		var rw adguardRewrite
+		switch r := rr.(type) {
+		case *dns.A:
+			rw = adguardRewrite{Domain: name, Answer: r.A.String()}
+		case *dns.AAAA:
+			rw = adguardRewrite{Domain: name, Answer: r.AAAA.String()}
+		case *dns.CNAME:
+			rw = adguardRewrite{Domain: name, Answer: strings.TrimSuffix(r.Target, ".")}
+		default:
+			continue
+		}
+		desired[rw.String()] = rw
+	}
+
+	a.mux.Lock()
+	a.pending = desired
+	a.mux.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (a *AdGuardSink) Run() {
+	ticker := time.NewTicker(updateRetry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.wake:
+		case <-ticker.C:
+		}
+		a.flush()
+	}
+}
+
+// flush syncs the queued rewrites. If that fails, they are queued again,
+// unless newer ones arrived in the meantime.
+func (a *AdGuardSink) flush() {
+	a.mux.Lock()
+	desired := a.pending
+	a.pending = nil
+	a.mux.Unlock()
+	if desired == nil {
+		return
+	}
+
+	if err := a.Update(desired); err != nil {
+		logger.Errorf("AdGuard: Error updating rewrites on %s, retrying in %s: %v", a.config.AdGuardURL, updateRetry, err)
+		a.mux.Lock()
+		if a.pending == nil {
+			a.pending = desired
+		}
+		a.mux.Unlock()
+	}
+}
+
+func (a *AdGuardSink) Update(desired map[string]adguardRewrite) error {
+	existing := []adguardRewrite{}
+	if err := a.request(http.MethodGet, "/control/rewrite/list", nil, &existing); err != nil {
+		return err
+	}
+	present := map[string]bool{}
+	for _, rw := range existing {
+		present[rw.String()] = true
+	}
+
+	// Only rewrites coredock added itself are owned, and may be removed later.
+	owned := []string{}
+	removed, added := 0, 0
+	for _, key := range a.db.AdGuardRewrites() {
+		if _, ok := desired[key]; ok {
+			owned = append(owned, key)
+			continue
+		}
+		if !present[key] {
+			continue
+		}
+		domain, answer, _ := strings.Cut(key, " ")
+		if err := a.request(http.MethodPost, "/control/rewrite/delete", adguardRewrite{Domain: domain, Answer: answer}, nil); err != nil {
+			return err
+		}
+		removed++
+	}
+	for key, rw := range desired {
+		if present[key] {
+			continue
+		}
+		if err := a.request(http.MethodPost, "/control/rewrite/add", rw, nil); err != nil {
+			a.db.SetAdGuardRewrites(owned)
+			return err
+		}
+		owned = append(owned, key)
+		added++
+	}
+	a.db.SetAdGuardRewrites(funk.UniqString(owned))
+
+	if removed > 0 || added > 0 {
+		logger.Infof("AdGuard: Updated rewrites on %s, %d removed, %d added", a.config.AdGuardURL, removed, added)
+	}
+	return nil
+}
+
+func (a *AdGuardSink) request(method string, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(a.config.AdGuardURL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.config.AdGuardUsername != "" {
+		req.SetBasicAuth(a.config.AdGuardUsername, a.config.AdGuardPassword)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("AdGuard API error on %s: %s %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
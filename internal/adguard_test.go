@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// fakeAdGuard implements the rewrite endpoints of the AdGuard Home API.
+type fakeAdGuard struct {
+	mux      sync.Mutex
+	rewrites []adguardRewrite
+	down     bool
+}
+
+func (f *fakeAdGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/control/rewrite/list":
+		json.NewEncoder(w).Encode(f.rewrites)
+	case "/control/rewrite/add":
+		rw := adguardRewrite{}
+		json.NewDecoder(r.Body).Decode(&rw)
+		f.rewrites = append(f.rewrites, rw)
+	case "/control/rewrite/delete":
+		rw := adguardRewrite{}
+		json.NewDecoder(r.Body).Decode(&rw)
+		kept := []adguardRewrite{}
+		for _, existing := range f.rewrites {
+			if existing != rw {
+				kept = append(kept, existing)
+			}
+		}
+		f.rewrites = kept
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeAdGuard) list() []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	list := []string{}
+	for _, rw := range f.rewrites {
+		list = append(list, rw.String())
+	}
+	sort.Strings(list)
+	return list
+}
+
+func equalStrings(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestAdGuardSink(t *testing.T) {
+	fake := &fakeAdGuard{rewrites: []adguardRewrite{{Domain: "nas.example", Answer: "10.0.0.9"}}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	db := newTestDB(t)
+	sink := NewAdGuardSink(&Config{AdGuardURL: server.URL, AdGuardUsername: "admin", AdGuardPassword: "secret"}, db)
+
+	set := &RecordSet{Zones: map[string]*Zone{"example": {Name: "example", SOA: testSOA(t, 1), Records: mustRRs(t,
+		"web.example. 300 IN A 10.0.0.2",
+		"www.example. 300 IN CNAME web.example.",
+	)}}}
+	if err := sink.Write(set); err != nil {
+		t.Fatal(err)
+	}
+	sink.flush()
+	equalStrings(t, fake.list(), "nas.example 10.0.0.9", "web.example 10.0.0.2", "www.example web.example")
+
+	// The alias is gone, the rewrite created by the user stays.
+	set.Zones["example"].Records = mustRRs(t, "web.example. 300 IN A 10.0.0.3")
+	if err := sink.Write(set); err != nil {
+		t.Fatal(err)
+	}
+	sink.flush()
+	equalStrings(t, fake.list(), "nas.example 10.0.0.9", "web.example 10.0.0.3")
+	equalStrings(t, db.AdGuardRewrites(), "web.example 10.0.0.3")
+}
+
+func TestAdGuardSinkRetries(t *testing.T) {
+	fake := &fakeAdGuard{down: true}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	sink := NewAdGuardSink(&Config{AdGuardURL: server.URL, AdGuardUsername: "admin", AdGuardPassword: "secret"}, newTestDB(t))
+	set := &RecordSet{Zones: map[string]*Zone{"example": {Name: "example", SOA: testSOA(t, 1), Records: mustRRs(t,
+		"web.example. 300 IN A 10.0.0.2",
+	)}}}
+	if err := sink.Write(set); err != nil {
+		t.Fatal(err)
+	}
+	sink.flush()
+	if sink.pending == nil {
+		t.Fatalf("expected the rewrites to stay queued")
+	}
+
+	fake.mux.Lock()
+	fake.down = false
+	fake.mux.Unlock()
+	sink.flush()
+	equalStrings(t, fake.list(), "web.example 10.0.0.2")
+	if sink.pending != nil {
+		t.Fatalf("expected nothing to be queued, got %v", sink.pending)
+	}
+}
+
+func TestAdGuardRewritesMigration(t *testing.T) {
+	db := newTestDB(t)
+	db.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx, "pushed", "adguard/rewrites", []string{"web.example 10.0.0.2"})
+	})
+
+	equalStrings(t, db.AdGuardRewrites(), "web.example 10.0.0.2")
+	if records := db.PushedRecords("adguard/rewrites"); len(records) != 0 {
+		t.Fatalf("expected the rewrites to be moved, got %v", records)
+	}
+	equalStrings(t, db.AdGuardRewrites(), "web.example 10.0.0.2")
+}
@@ -1,20 +1,70 @@
 package internal
 
 import (
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/thoas/go-funk"
 )
 
 type Config struct {
-	Domains          []string
-	Networks         []string
-	TTL              int
-	IPPrefixes       []string
-	IPPrefixesIgnore []string
-	ReuseIPs         bool
+	Domains              []string
+	Networks             []string
+	TTL                  int
+	IPPrefixes           []string
+	IPPrefixesIgnore     []string
+	ReuseIPs             bool
+	IPLease              time.Duration
+	DataDir              string
+	ZoneDir              string
+	TransferListen       string
+	TransferAllow        []string
+	TransferNotify       []string
+	RFC2136Server        string
+	RFC2136Zones         []string
+	RFC2136TSIGName      string
+	RFC2136TSIGSecret    string
+	RFC2136TSIGAlgorithm string
+	Outputs              []string
+	HostsFile            string
+	DnsmasqFile          string
+	UnboundFile          string
+	JSONFile             string
+	UnboundZoneType      string
+	PiholeHostsFile      string
+	PiholeCNAMEFile      string
+	AdGuardURL           string
+	AdGuardUsername      string
+	AdGuardPassword      string
+	DNSSEC               bool
+	StaticDir            string
+	StaticRecords        []string
+	HostIPs              []string
+	HostNetwork          bool
+	PublishHost          bool
+	HostName             string
+	NetworkDomains       map[string][]string
+	Views                []View
+	Nameservers          []string
+	IPOrder              []string
+	LoadBalance          bool
+	RequireHealthy       bool
+	StoppedGrace         time.Duration
+	Self                 string
+	PublishSelf          bool
+	NSNames              []string
+	NSAddresses          []string
+	SOAMbox              string
+	SOARefresh           uint32
+	SOARetry             uint32
+	SOAExpire            uint32
+	SOAMinimum           uint32
 }
 
 func NewConfig() *Config {
@@ -24,6 +74,9 @@ func NewConfig() *Config {
 		TTL:        300,
 		IPPrefixes: []string{},
 		ReuseIPs:   false,
+		IPLease:    30 * 24 * time.Hour,
+		DataDir:    ".",
+		ZoneDir:    "/tmp/coredock",
 	}
 
 	domains := os.Getenv("COREDOCK_DOMAINS")
@@ -41,16 +94,158 @@ func NewConfig() *Config {
 		ttl = t
 	}
 
+	if lease, err := time.ParseDuration(os.Getenv("COREDOCK_IP_LEASE")); err == nil {
+		c.IPLease = lease
+	}
+	if dir := os.Getenv("COREDOCK_DATA_DIR"); dir != "" {
+		c.DataDir = dir
+	}
+	if dir := os.Getenv("COREDOCK_ZONE_DIR"); dir != "" {
+		c.ZoneDir = dir
+	}
+
 	c.TTL = ttl
 	c.ReuseIPs = saveIps
-	c.Domains = funk.Filter(strings.Split(domains, ","), func(s string) bool { return s != "" }).([]string)
-	c.Domains = funk.Map(c.Domains, func(s string) string { return strings.TrimSpace(s) }).([]string)
-	c.Networks = funk.Filter(strings.Split(networks, ","), func(s string) bool { return s != "" }).([]string)
-	c.Networks = funk.Map(c.Networks, func(s string) string { return strings.TrimSpace(s) }).([]string)
-	c.IPPrefixes = funk.Filter(strings.Split(ipPrefixes, ","), func(s string) bool { return s != "" }).([]string)
-	c.IPPrefixes = funk.Map(c.IPPrefixes, func(s string) string { return strings.TrimSpace(s) }).([]string)
-	c.IPPrefixesIgnore = funk.Filter(strings.Split(ipPrefixesIgnore, ","), func(s string) bool { return s != "" }).([]string)
-	c.IPPrefixesIgnore = funk.Map(c.IPPrefixesIgnore, func(s string) string { return strings.TrimSpace(s) }).([]string)
+	c.Domains = splitList(domains)
+	c.Networks = splitList(networks)
+	c.IPPrefixes = splitList(ipPrefixes)
+	c.IPPrefixesIgnore = splitList(ipPrefixesIgnore)
+
+	c.TransferListen = os.Getenv("COREDOCK_TRANSFER_LISTEN")
+	c.TransferAllow = splitList(os.Getenv("COREDOCK_TRANSFER_ALLOW"))
+	c.TransferNotify = splitList(os.Getenv("COREDOCK_TRANSFER_NOTIFY"))
+
+	c.RFC2136Server = os.Getenv("COREDOCK_RFC2136_SERVER")
+	c.RFC2136Zones = splitList(os.Getenv("COREDOCK_RFC2136_ZONES"))
+	c.RFC2136TSIGName = os.Getenv("COREDOCK_RFC2136_TSIG_NAME")
+	c.RFC2136TSIGSecret = os.Getenv("COREDOCK_RFC2136_TSIG_SECRET")
+	c.RFC2136TSIGAlgorithm = os.Getenv("COREDOCK_RFC2136_TSIG_ALGORITHM")
+	if c.RFC2136TSIGAlgorithm == "" {
+		c.RFC2136TSIGAlgorithm = dns.HmacSHA256
+	}
+
+	c.Outputs = splitList(os.Getenv("COREDOCK_OUTPUTS"))
+	if len(c.Outputs) == 0 {
+		c.Outputs = []string{"zonefile"}
+	}
+	c.HostsFile = envOrDefault("COREDOCK_HOSTS_FILE", filepath.Join(c.ZoneDir, "hosts"))
+	c.DnsmasqFile = envOrDefault("COREDOCK_DNSMASQ_FILE", filepath.Join(c.ZoneDir, "dnsmasq.conf"))
+	c.UnboundFile = envOrDefault("COREDOCK_UNBOUND_FILE", filepath.Join(c.ZoneDir, "unbound.conf"))
+	c.JSONFile = envOrDefault("COREDOCK_JSON_FILE", filepath.Join(c.ZoneDir, "coredock.json"))
+	c.UnboundZoneType = envOrDefault("COREDOCK_UNBOUND_ZONE_TYPE", "transparent")
+	c.PiholeHostsFile = envOrDefault("COREDOCK_PIHOLE_HOSTS_FILE", filepath.Join(c.ZoneDir, "custom.list"))
+	c.PiholeCNAMEFile = envOrDefault("COREDOCK_PIHOLE_CNAME_FILE", filepath.Join(c.ZoneDir, "05-pihole-custom-cname.conf"))
+	c.AdGuardURL = os.Getenv("COREDOCK_ADGUARD_URL")
+	c.AdGuardUsername = os.Getenv("COREDOCK_ADGUARD_USERNAME")
+	c.AdGuardPassword = os.Getenv("COREDOCK_ADGUARD_PASSWORD")
+	c.DNSSEC = os.Getenv("COREDOCK_DNSSEC") == "true"
+	c.HostIPs = splitList(os.Getenv("COREDOCK_HOST_IPS"))
+	c.PublishHost = os.Getenv("COREDOCK_PUBLISH_HOST") == "true"
+	c.HostName = os.Getenv("COREDOCK_HOST_NAME")
+	c.Views = parseViews(os.Getenv("COREDOCK_VIEWS"))
+	c.Nameservers = splitList(os.Getenv("COREDOCK_NAMESERVERS"))
+	c.RequireHealthy = os.Getenv("COREDOCK_REQUIRE_HEALTHY") == "true"
+	c.Self = strings.TrimSpace(os.Getenv("COREDOCK_SELF"))
+	c.PublishSelf = os.Getenv("COREDOCK_PUBLISH_SELF") == "true"
+	c.NSNames = splitList(os.Getenv("COREDOCK_NS_NAMES"))
+	c.NSAddresses = splitList(os.Getenv("COREDOCK_NS_ADDRESSES"))
+	c.SOAMbox = envOrDefault("COREDOCK_SOA_MBOX", "hostmaster")
+	c.SOARefresh = envSeconds("COREDOCK_SOA_REFRESH", 28800)
+	c.SOARetry = envSeconds("COREDOCK_SOA_RETRY", 7200)
+	c.SOAExpire = envSeconds("COREDOCK_SOA_EXPIRE", 604800)
+	c.SOAMinimum = envSeconds("COREDOCK_SOA_MINIMUM", uint32(c.TTL))
+	if v := os.Getenv("COREDOCK_STOPPED_GRACE"); v != "" {
+		grace, err := parseKeepWhenStopped(v)
+		if err != nil {
+			logger.Warnf("Ignoring invalid COREDOCK_STOPPED_GRACE '%s', expected true, false or a duration", v)
+		}
+		c.StoppedGrace = grace
+	}
+	c.IPOrder = splitList(os.Getenv("COREDOCK_IP_ORDER"))
+	// loadbalance shuffles answers, which defeats a configured order.
+	c.LoadBalance = envOrDefault("COREDOCK_LOADBALANCE", strconv.FormatBool(len(c.IPOrder) == 0)) == "true"
+	c.NetworkDomains = parseNetworkDomains(os.Getenv("COREDOCK_NETWORK_DOMAINS"))
+	c.StaticDir = os.Getenv("COREDOCK_STATIC_DIR")
+	c.StaticRecords = funk.FilterString(funk.Map(strings.FieldsFunc(os.Getenv("COREDOCK_STATIC_RECORDS"), func(r rune) bool {
+		return r == ';' || r == '\n'
+	}), strings.TrimSpace).([]string), func(s string) bool { return s != "" })
 
 	return c
 }
+
+// AllowsIP applies COREDOCK_IP_PREFIXES and COREDOCK_IGNORE_IP_PREFIXES to the
+// addresses of one network endpoint. It is enough if one of them matches.
+func (c *Config) AllowsIP(ips ...net.IP) bool {
+	matches := func(prefixes []string) bool {
+		for _, ip := range ips {
+			if ip == nil {
+				continue
+			}
+			for _, p := range prefixes {
+				if strings.HasPrefix(ip.String(), p) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if len(c.IPPrefixes) > 0 && !matches(c.IPPrefixes) {
+		return false
+	}
+	return !matches(c.IPPrefixesIgnore)
+}
+
+// parseNetworkDomains parses a list of network:domain pairs. Invalid entries
+// are skipped with a warning.
+func parseNetworkDomains(value string) map[string][]string {
+	networkDomains := map[string][]string{}
+	for _, entry := range splitList(value) {
+		nw, domain, ok := strings.Cut(entry, ":")
+		nw, domain = strings.TrimSpace(nw), strings.TrimSpace(domain)
+		if !ok || nw == "" || domain == "" {
+			logger.Warnf("Ignoring invalid network domain '%s', expected network:domain", entry)
+			continue
+		}
+		if !funk.ContainsString(networkDomains[nw], domain) {
+			networkDomains[nw] = append(networkDomains[nw], domain)
+		}
+	}
+	return networkDomains
+}
+
+// DomainNetworks returns the sorted networks mapped to a domain with
+// COREDOCK_NETWORK_DOMAINS, or nil if the domain isn't mapped.
+func (c *Config) DomainNetworks(domain string) []string {
+	var networks []string
+	for nw, domains := range c.NetworkDomains {
+		if funk.ContainsString(domains, domain) {
+			networks = append(networks, nw)
+		}
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+func envOrDefault(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envSeconds reads a number of seconds or a duration, i.e. 3600 or 1h.
+func envSeconds(key string, def uint32) uint32 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if secs, err := strconv.ParseUint(v, 10, 32); err == nil {
+		return uint32(secs)
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return uint32(d.Seconds())
+	}
+	return def
+}
+
+func splitList(s string) []string {
+	list := funk.Map(strings.Split(s, ","), func(s string) string { return strings.TrimSpace(s) }).([]string)
+	return funk.FilterString(list, func(s string) bool { return s != "" })
+}
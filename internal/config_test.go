@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseNetworkDomains(t *testing.T) {
+	tests := []struct {
+		value string
+		want  map[string][]string
+	}{
+		{"", map[string][]string{}},
+		{"macvlan:lan", map[string][]string{"macvlan": {"lan"}}},
+		{" macvlan : lan , backend:internal,macvlan:home.lan", map[string][]string{"macvlan": {"lan", "home.lan"}, "backend": {"internal"}}},
+		{"macvlan:lan,macvlan:lan", map[string][]string{"macvlan": {"lan"}}},
+		{"macvlan,:lan,backend:,vpn:vpn.lan", map[string][]string{"vpn": {"vpn.lan"}}},
+	}
+	for _, tt := range tests {
+		if got := parseNetworkDomains(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseNetworkDomains(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDomainNetworks(t *testing.T) {
+	c := &Config{NetworkDomains: parseNetworkDomains("vpn:lan,macvlan:lan,backend:internal")}
+	equalStrings(t, c.DomainNetworks("lan"), "macvlan", "vpn")
+	equalStrings(t, c.DomainNetworks("internal"), "backend")
+	if networks := c.DomainNetworks("example"); networks != nil {
+		t.Fatalf("expected an unmapped domain to have no networks, got %v", networks)
+	}
+}
+
+func TestIPsForNetworkDomains(t *testing.T) {
+	d := NewDNSProvider(&Config{NetworkDomains: parseNetworkDomains("macvlan:lan")})
+	s := &Service{
+		IPs:        []net.IP{net.ParseIP("192.168.1.10"), net.ParseIP("172.18.0.2")},
+		NetworkIPs: map[string][]net.IP{"macvlan": {net.ParseIP("192.168.1.10")}, "backend": {net.ParseIP("172.18.0.2")}},
+	}
+	if ips := d.ipsFor(s, "lan"); len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.168.1.10")) {
+		t.Fatalf("expected only the macvlan IP in lan, got %v", ips)
+	}
+	if ips := d.ipsFor(s, "example"); len(ips) != 2 {
+		t.Fatalf("expected all IPs in an unmapped domain, got %v", ips)
+	}
+}
+
+func TestConfigDirectories(t *testing.T) {
+	t.Setenv("COREDOCK_DATA_DIR", "")
+	t.Setenv("COREDOCK_ZONE_DIR", "")
+	c := NewConfig()
+	if c.DataDir != "." || c.ZoneDir != "/tmp/coredock" {
+		t.Fatalf("unexpected default directories %s and %s", c.DataDir, c.ZoneDir)
+	}
+
+	t.Setenv("COREDOCK_DATA_DIR", "/var/lib/coredock")
+	t.Setenv("COREDOCK_ZONE_DIR", "/etc/coredns/zones")
+	c = NewConfig()
+	if c.DataDir != "/var/lib/coredock" || c.ZoneDir != "/etc/coredns/zones" {
+		t.Fatalf("unexpected directories %s and %s", c.DataDir, c.ZoneDir)
+	}
+	if c.HostsFile != "/etc/coredns/zones/hosts" {
+		t.Fatalf("expected outputs to default to the zone directory, got %s", c.HostsFile)
+	}
+}
+
+func TestDBInDataDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	db, err := NewDB(&Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.db.Close()
+	if _, err := os.Stat(filepath.Join(dir, "data.db")); err != nil {
+		t.Fatalf("expected the database in the data directory: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CoreDNS serving the zone directory. The outer server forwards to it, or
+// to COREDOCK_NAMESERVERS.
+const innerCoreDNS = "127.0.0.1:5311"
+
+// WriteCorefiles writes the Corefile of the inner CoreDNS, which serves the
+// zone files, and Corefile.forward for the outer one. The inner server only
+// sees queries from the outer one, so views have to live in the outer one.
+func WriteCorefiles(config *Config) error {
+	if err := CreateZoneDir(config); err != nil {
+		return err
+	}
+
+	loadbalance := ""
+	if config.LoadBalance {
+		loadbalance = "    loadbalance\n"
+	}
+
+	corefile := fmt.Sprintf(`
+. {
+    auto {
+        directory %s/
+        reload 1s
+    }
+%s}
+`, config.ZoneDir, loadbalance)
+
+	upstreams := innerCoreDNS
+	if len(config.Nameservers) > 0 {
+		upstreams = strings.Join(config.Nameservers, " ")
+	}
+	fanout := fmt.Sprintf(`    fanout . %s {
+      timeout 300ms
+    }
+`, upstreams)
+
+	forward := ""
+	for _, view := range config.Views {
+		if err := os.MkdirAll(view.ZoneDir(config), 0o755); err != nil {
+			return fmt.Errorf("error creating %s directory: %s", view.ZoneDir(config), err)
+		}
+		exprs := []string{}
+		for _, cidr := range view.CIDRs {
+			exprs = append(exprs, fmt.Sprintf("incidr(client_ip(), '%s')", cidr))
+		}
+		forward += fmt.Sprintf(`
+. {
+    view %s {
+        expr %s
+    }
+    log
+    auto {
+        directory %s/
+        reload 1s
+    }
+%s%s}
+`, view.Name, strings.Join(exprs, " || "), view.ZoneDir(config), loadbalance, fanout)
+	}
+	forward += fmt.Sprintf(`
+. {
+    log
+%s}
+`, fanout)
+
+	if err := writeFileIfChanged(filepath.Join(config.ZoneDir, "Corefile"), []byte(corefile)); err != nil {
+		return err
+	}
+	return writeFileIfChanged(filepath.Join(config.ZoneDir, "Corefile.forward"), []byte(forward))
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteCorefiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "zones")
+	config := &Config{ZoneDir: dir, Views: []View{{Name: "lan", CIDRs: []string{"192.168.1.0/24"}, Networks: []string{"macvlan"}}}}
+	if err := WriteCorefiles(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// The inner server loads the zone directory recursively, the zones of
+	// views must not end up in it.
+	viewDir := config.Views[0].ZoneDir(config)
+	if rel, err := filepath.Rel(dir, viewDir); err != nil || !strings.HasPrefix(rel, "..") {
+		t.Fatalf("expected the view directory %s outside of %s", viewDir, dir)
+	}
+	if _, err := os.Stat(viewDir); err != nil {
+		t.Fatalf("expected the view directory to be created: %v", err)
+	}
+
+	corefile, err := os.ReadFile(filepath.Join(dir, "Corefile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(corefile), "directory "+dir+"/\n") || strings.Contains(string(corefile), viewDir) {
+		t.Fatalf("expected only the zone directory in the Corefile:\n%s", corefile)
+	}
+	forward, err := os.ReadFile(filepath.Join(dir, "Corefile.forward"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"view lan", "incidr(client_ip(), '192.168.1.0/24')", "directory " + viewDir + "/\n", "fanout . " + innerCoreDNS} {
+		if !strings.Contains(string(forward), want) {
+			t.Errorf("expected %q in Corefile.forward:\n%s", want, forward)
+		}
+	}
+}
@@ -1,44 +1,523 @@
 package internal
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
 	bolt "go.etcd.io/bbolt"
 )
 
 type DB struct {
-	db *bolt.DB
+	db    *bolt.DB
+	lease time.Duration
+}
+
+type Reservation struct {
+	Container string    `json:"container"`
+	Network   string    `json:"network"`
+	IPv4      string    `json:"ipv4,omitempty"`
+	IPv6      string    `json:"ipv6,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// reservationRefresh is how often the last seen time of an unchanged
+// reservation is written, instead of on every poll.
+const reservationRefresh = time.Minute
+
+func (r *Reservation) expired(lease time.Duration) bool {
+	return lease > 0 && time.Since(r.LastSeen) > lease
+}
+
+func NewDB(conf *Config) (*DB, error) {
+	if err := os.MkdirAll(conf.DataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating data directory %s: %w", conf.DataDir, err)
+	}
+
+	path := filepath.Join(conf.DataDir, "data.db")
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening database %s: %w", path, err)
+	}
+	return &DB{db: db, lease: conf.IPLease}, nil
+}
+
+func reservationKey(container string, network string) []byte {
+	return []byte(container + "/" + network)
+}
+
+// Reservation returns the stored IPs of a container on a network, or nil if
+// there are none or the lease has expired. Reservations written by older
+// versions as plain "<container>-<network>:ipv4" keys are migrated on read.
+func (d *DB) Reservation(container string, network string) *Reservation {
+	var r *Reservation
+	legacy := false
+	d.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("reservations")); b != nil {
+			if v := b.Get(reservationKey(container, network)); v != nil {
+				r = &Reservation{}
+				if err := json.Unmarshal(v, r); err != nil {
+					logger.Errorf("DB: Invalid reservation for %s on %s: %v", container, network, err)
+					r = nil
+				}
+				return nil
+			}
+		}
+		if b := tx.Bucket([]byte("services")); b != nil {
+			legacyKey := container + "-" + network
+			legacy = b.Get([]byte(legacyKey+":ipv4")) != nil || b.Get([]byte(legacyKey+":ipv6")) != nil
+		}
+		return nil
+	})
+	if legacy {
+		r = d.migrateReservation(container, network)
+	}
+
+	if r != nil && r.expired(d.lease) {
+		logger.Debugf("DB: Reservation for %s on %s expired", container, network)
+		return nil
+	}
+	if r != nil {
+		logger.Debugf("DB: Found reservation for %s on %s: ipv4=%s ipv6=%s", container, network, r.IPv4, r.IPv6)
+	}
+	return r
+}
+
+func (d *DB) migrateReservation(container string, network string) *Reservation {
+	var r *Reservation
+	d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("reservations"))
+		if err != nil {
+			return err
+		}
+		legacy := tx.Bucket([]byte("services"))
+		if legacy == nil {
+			return nil
+		}
+		legacyKey := container + "-" + network
+		ipv4 := string(legacy.Get([]byte(legacyKey + ":ipv4")))
+		ipv6 := string(legacy.Get([]byte(legacyKey + ":ipv6")))
+		if ipv4 == "" && ipv6 == "" {
+			return nil
+		}
+		now := time.Now()
+		r = &Reservation{Container: container, Network: network, IPv4: ipv4, IPv6: ipv6, FirstSeen: now, LastSeen: now}
+		logger.Debugf("DB: Migrating legacy reservation for %s on %s", container, network)
+		if err := deleteLegacyReservation(tx, container, network); err != nil {
+			return err
+		}
+		return putReservation(b, r)
+	})
+	return r
+}
+
+// deleteLegacyReservation removes the keys older versions stored for a
+// container on a network, so they can't come back once the migrated
+// reservation expired.
+func deleteLegacyReservation(tx *bolt.Tx, container string, network string) error {
+	legacy := tx.Bucket([]byte("services"))
+	if legacy == nil {
+		return nil
+	}
+	legacyKey := container + "-" + network
+	if err := legacy.Delete([]byte(legacyKey + ":ipv4")); err != nil {
+		return err
+	}
+	return legacy.Delete([]byte(legacyKey + ":ipv6"))
+}
+
+// Reserve stores the IPs a container currently holds on a network. An address
+// can only be reserved once per network, so it is taken away from any other
+// container that still holds it. Unchanged reservations are only refreshed.
+func (d *DB) Reserve(container string, network string, ipv4 string, ipv6 string) {
+	key := reservationKey(container, network)
+	var current *Reservation
+	d.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("reservations")); b != nil {
+			if v := b.Get(key); v != nil && json.Unmarshal(v, &current) != nil {
+				current = nil
+			}
+		}
+		return nil
+	})
+	if current != nil && current.IPv4 == ipv4 && current.IPv6 == ipv6 {
+		if time.Since(current.LastSeen) < reservationRefresh {
+			return
+		}
+		current.LastSeen = time.Now()
+		d.db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("reservations"))
+			if err != nil {
+				return err
+			}
+			return putReservation(b, current)
+		})
+		return
+	}
+
+	d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("reservations"))
+		if err != nil {
+			return err
+		}
+		if err := deleteLegacyReservation(tx, container, network); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		r := &Reservation{Container: container, Network: network, FirstSeen: now}
+		if v := b.Get(key); v != nil {
+			json.Unmarshal(v, r)
+		}
+		r.IPv4 = ipv4
+		r.IPv6 = ipv6
+		r.LastSeen = now
+
+		stale := []*Reservation{}
+		b.ForEach(func(k, v []byte) error {
+			if string(k) == string(key) {
+				return nil
+			}
+			other := &Reservation{}
+			if json.Unmarshal(v, other) != nil || other.Network != network {
+				return nil
+			}
+			if ipv4 != "" && other.IPv4 == ipv4 || ipv6 != "" && other.IPv6 == ipv6 {
+				stale = append(stale, other)
+			}
+			return nil
+		})
+		for _, other := range stale {
+			logger.Infof("DB: Releasing reservation of '%s' on '%s', the address now belongs to '%s'", other.Container, network, container)
+			if other.IPv4 == ipv4 {
+				other.IPv4 = ""
+			}
+			if other.IPv6 == ipv6 {
+				other.IPv6 = ""
+			}
+			if other.IPv4 == "" && other.IPv6 == "" {
+				b.Delete(reservationKey(other.Container, other.Network))
+				continue
+			}
+			if err := putReservation(b, other); err != nil {
+				return err
+			}
+		}
+
+		logger.Debugf("DB: Reserving ipv4=%s ipv6=%s for %s on %s", ipv4, ipv6, container, network)
+		return putReservation(b, r)
+	})
 }
 
-func NewDB() *DB {
+// CollectGarbage removes expired reservations. Legacy reservations have no
+// last seen time, they are dropped once a lease has passed since this
+// version first found them. Those still in use were migrated by then.
+func (d *DB) CollectGarbage() {
+	if d.lease <= 0 {
+		return
+	}
+	d.db.Update(func(tx *bolt.Tx) error {
+		if err := collectLegacyReservations(tx, d.lease); err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte("reservations"))
+		if b == nil {
+			return nil
+		}
+		expired := [][]byte{}
+		b.ForEach(func(k, v []byte) error {
+			r := &Reservation{}
+			if json.Unmarshal(v, r) != nil || r.expired(d.lease) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			logger.Infof("DB: Removing expired reservation %s", string(k))
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	db, err := bolt.Open("data.db", 0600, nil)
+func collectLegacyReservations(tx *bolt.Tx, lease time.Duration) error {
+	if tx.Bucket([]byte("services")) == nil {
+		return nil
+	}
+	meta, err := tx.CreateBucketIfNotExists([]byte("meta"))
 	if err != nil {
+		return err
+	}
+	since := time.Time{}
+	if since.UnmarshalText(meta.Get([]byte("legacy_since"))) != nil {
+		v, _ := time.Now().MarshalText()
+		return meta.Put([]byte("legacy_since"), v)
+	}
+	if time.Since(since) <= lease {
 		return nil
 	}
-	return &DB{db: db}
+	logger.Infof("DB: Removing legacy reservations that were not migrated")
+	if err := tx.DeleteBucket([]byte("services")); err != nil {
+		return err
+	}
+	return meta.Delete([]byte("legacy_since"))
 }
 
-func (d *DB) Get(key string) string {
-	var value []byte
+func putReservation(b *bolt.Bucket, r *Reservation) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return b.Put(reservationKey(r.Container, r.Network), v)
+}
+
+type ZoneState struct {
+	Hash     string    `json:"hash"`
+	Serial   uint32    `json:"serial"`
+	SignedAt time.Time `json:"signed_at"`
+}
+
+func (d *DB) ZoneState(zone string) *ZoneState {
+	state := &ZoneState{}
 	d.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("services"))
+		b := tx.Bucket([]byte("zones"))
 		if b == nil {
 			return nil
 		}
-		value = b.Get([]byte(key))
+		if v := b.Get([]byte(zone)); v != nil {
+			return json.Unmarshal(v, state)
+		}
 		return nil
 	})
-	v := string(value)
-	logger.Debugf("DB: Found key %s with value %s", key, v)
-	return v
+	return state
 }
 
-func (d *DB) Set(key string, value string) {
+func (d *DB) ZoneStates() map[string]*ZoneState {
+	states := map[string]*ZoneState{}
+	d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("zones"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			state := &ZoneState{}
+			if json.Unmarshal(v, state) == nil {
+				states[string(k)] = state
+			}
+			return nil
+		})
+	})
+	return states
+}
+
+func (d *DB) SetZoneState(zone string, state *ZoneState) {
 	d.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte("services"))
+		b, err := tx.CreateBucketIfNotExists([]byte("zones"))
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(state)
 		if err != nil {
 			return err
 		}
-		logger.Debugf("DB: Setting key %s to value %s", key, value)
-		return b.Put([]byte(key), []byte(value))
+		logger.Debugf("DB: Setting zone %s to serial %d", zone, state.Serial)
+		return b.Put([]byte(zone), v)
+	})
+}
+
+// KnownService is the last known state of a container, kept to publish it
+// while it is stopped.
+type KnownService struct {
+	Service   Service   `json:"service"`
+	StoppedAt time.Time `json:"stopped_at"`
+}
+
+func (d *DB) KnownServices() map[string]*KnownService {
+	known := map[string]*KnownService{}
+	d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("known"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			service := &KnownService{}
+			if json.Unmarshal(v, service) == nil {
+				known[string(k)] = service
+			}
+			return nil
+		})
+	})
+	return known
+}
+
+// SetKnownServices replaces the known services, containers that are gone are
+// forgotten.
+func (d *DB) SetKnownServices(known map[string]*KnownService) {
+	d.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("known")) != nil {
+			if err := tx.DeleteBucket([]byte("known")); err != nil {
+				return err
+			}
+		}
+		for id, service := range known {
+			if err := putJSON(tx, "known", id, service); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *DB) PushedRecords(zone string) []string {
+	records := []string{}
+	d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("pushed"))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(zone)); v != nil {
+			return json.Unmarshal(v, &records)
+		}
+		return nil
+	})
+	return records
+}
+
+// SetPushedRecords stores the records of a zone after a successful push. A
+// zone without records is forgotten.
+func (d *DB) SetPushedRecords(zone string, records []string) {
+	d.db.Update(func(tx *bolt.Tx) error {
+		if len(records) == 0 {
+			if b := tx.Bucket([]byte("pushed")); b != nil {
+				return b.Delete([]byte(zone))
+			}
+			return nil
+		}
+		return putJSON(tx, "pushed", zone, records)
+	})
+}
+
+// PushedZones returns the zones with records on the RFC 2136 server.
+func (d *DB) PushedZones() []string {
+	zones := []string{}
+	d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("pushed"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			zones = append(zones, string(k))
+			return nil
+		})
+	})
+	return zones
+}
+
+// AdGuardRewrites returns the rewrites coredock created in AdGuard Home.
+// Older versions kept them with the RFC 2136 records, they are moved on read.
+func (d *DB) AdGuardRewrites() []string {
+	rewrites := []string{}
+	legacy := false
+	d.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("adguard")); b != nil {
+			if v := b.Get([]byte("rewrites")); v != nil {
+				return json.Unmarshal(v, &rewrites)
+			}
+		}
+		if b := tx.Bucket([]byte("pushed")); b != nil {
+			legacy = b.Get([]byte("adguard/rewrites")) != nil
+		}
+		return nil
+	})
+	if legacy {
+		d.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("pushed"))
+			if err := json.Unmarshal(b.Get([]byte("adguard/rewrites")), &rewrites); err != nil {
+				return err
+			}
+			logger.Debugf("DB: Migrating AdGuard rewrites")
+			if err := putJSON(tx, "adguard", "rewrites", rewrites); err != nil {
+				return err
+			}
+			return b.Delete([]byte("adguard/rewrites"))
+		})
+	}
+	return rewrites
+}
+
+func (d *DB) SetAdGuardRewrites(rewrites []string) {
+	d.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx, "adguard", "rewrites", rewrites)
+	})
+}
+
+func putJSON(tx *bolt.Tx, bucket string, key string, value any) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), v)
+}
+
+// Attachments are stored as "<containerID>/<network>" keys, so only the
+// network connections coredock made itself are ever reconciled.
+func (d *DB) AddAttachment(containerID string, network string) {
+	d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("attachments"))
+		if err != nil {
+			return err
+		}
+		logger.Debugf("DB: Recording attachment of %s to %s", containerID, network)
+		return b.Put([]byte(containerID+"/"+network), []byte{})
+	})
+}
+
+func (d *DB) RemoveAttachment(containerID string, network string) {
+	d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("attachments"))
+		if b == nil {
+			return nil
+		}
+		logger.Debugf("DB: Removing attachment of %s to %s", containerID, network)
+		return b.Delete([]byte(containerID + "/" + network))
+	})
+}
+
+func (d *DB) HasAttachment(containerID string, network string) bool {
+	found := false
+	d.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("attachments")); b != nil {
+			found = b.Get([]byte(containerID+"/"+network)) != nil
+		}
+		return nil
+	})
+	return found
+}
+
+func (d *DB) Attachments() map[string][]string {
+	attachments := map[string][]string{}
+	d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("attachments"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			containerID, network, ok := strings.Cut(string(k), "/")
+			if ok {
+				attachments[containerID] = append(attachments[containerID], network)
+			}
+			return nil
+		})
 	})
+	return attachments
 }
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := NewDB(&Config{DataDir: t.TempDir(), IPLease: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.db.Close() })
+	return db
+}
+
+func TestReservation(t *testing.T) {
+	db := newTestDB(t)
+
+	if r := db.Reservation("web", "lan"); r != nil {
+		t.Fatalf("expected no reservation, got %+v", r)
+	}
+
+	db.Reserve("web", "lan", "10.0.0.2", "")
+	r := db.Reservation("web", "lan")
+	if r == nil || r.IPv4 != "10.0.0.2" {
+		t.Fatalf("expected 10.0.0.2, got %+v", r)
+	}
+
+	// The address moves to another container.
+	db.Reserve("app", "lan", "10.0.0.2", "")
+	if r := db.Reservation("web", "lan"); r != nil {
+		t.Fatalf("expected the reservation of web to be released, got %+v", r)
+	}
+}
+
+func TestReservationMigratesLegacyKeys(t *testing.T) {
+	db := newTestDB(t)
+	db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("services"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("web-lan:ipv4"), []byte("10.0.0.3"))
+	})
+
+	r := db.Reservation("web", "lan")
+	if r == nil || r.IPv4 != "10.0.0.3" {
+		t.Fatalf("expected migrated reservation 10.0.0.3, got %+v", r)
+	}
+
+	db.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("services")).Get([]byte("web-lan:ipv4")); v != nil {
+			t.Errorf("legacy key was not removed")
+		}
+		return nil
+	})
+	if r := db.Reservation("web", "lan"); r == nil || r.IPv4 != "10.0.0.3" {
+		t.Fatalf("expected stored reservation 10.0.0.3, got %+v", r)
+	}
+}
+
+func putLegacyReservation(t *testing.T, db *DB, key string, ip string) {
+	t.Helper()
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("services"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte(ip))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setLastSeen(t *testing.T, db *DB, container string, network string, lastSeen time.Time) {
+	t.Helper()
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("reservations"))
+		r := &Reservation{}
+		if err := json.Unmarshal(b.Get(reservationKey(container, network)), r); err != nil {
+			return err
+		}
+		r.LastSeen = lastSeen
+		return putReservation(b, r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReserveReplacesLegacyKeys(t *testing.T) {
+	db := newTestDB(t)
+	putLegacyReservation(t, db, "web-lan:ipv4", "10.0.0.3")
+
+	// The container got a new address before its old one was looked up.
+	db.Reserve("web", "lan", "10.0.0.4", "")
+	setLastSeen(t, db, "web", "lan", time.Now().Add(-2*time.Hour))
+	db.CollectGarbage()
+
+	if r := db.Reservation("web", "lan"); r != nil {
+		t.Fatalf("expected the legacy reservation to be gone, got %+v", r)
+	}
+}
+
+func TestCollectGarbageDropsLegacyReservations(t *testing.T) {
+	db := newTestDB(t)
+	putLegacyReservation(t, db, "old-container-lan:ipv4", "10.0.0.9")
+
+	// The first run only notes when the legacy reservations were found.
+	db.CollectGarbage()
+	legacyBucket := func() bool {
+		found := false
+		db.db.View(func(tx *bolt.Tx) error {
+			found = tx.Bucket([]byte("services")) != nil
+			return nil
+		})
+		return found
+	}
+	if !legacyBucket() {
+		t.Fatalf("expected legacy reservations to be kept for a lease")
+	}
+
+	db.db.Update(func(tx *bolt.Tx) error {
+		v, _ := time.Now().Add(-2 * time.Hour).MarshalText()
+		return tx.Bucket([]byte("meta")).Put([]byte("legacy_since"), v)
+	})
+	db.CollectGarbage()
+	if legacyBucket() {
+		t.Fatalf("expected legacy reservations to be removed after a lease")
+	}
+}
+
+func TestReserveOnlyRefreshesUnchangedReservations(t *testing.T) {
+	db := newTestDB(t)
+	db.Reserve("web", "lan", "10.0.0.2", "")
+	first := db.Reservation("web", "lan").LastSeen
+
+	db.Reserve("web", "lan", "10.0.0.2", "")
+	if r := db.Reservation("web", "lan"); !r.LastSeen.Equal(first) {
+		t.Fatalf("expected an unchanged reservation not to be written again")
+	}
+
+	old := time.Now().Add(-reservationRefresh - time.Second)
+	setLastSeen(t, db, "web", "lan", old)
+	db.Reserve("web", "lan", "10.0.0.2", "")
+	if r := db.Reservation("web", "lan"); !r.LastSeen.After(old) || !r.FirstSeen.Equal(first) {
+		t.Fatalf("expected the last seen time to be refreshed, got %+v", r)
+	}
+}
+
+func TestKnownServices(t *testing.T) {
+	db := newTestDB(t)
+	stoppedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	db.SetKnownServices(map[string]*KnownService{
+		"abc": {Service: Service{ID: "abc", Name: "web", IPs: []net.IP{net.ParseIP("10.0.0.2")}, Domains: []string{"example"},
+			Records: []string{"txt IN TXT \"hello\""}}, StoppedAt: stoppedAt},
+		"def": {Service: Service{ID: "def", Name: "db"}},
+	})
+
+	known := db.KnownServices()
+	if len(known) != 2 {
+		t.Fatalf("expected two known services, got %d", len(known))
+	}
+	web := known["abc"]
+	if web.Service.Name != "web" || !web.Service.IPs[0].Equal(net.ParseIP("10.0.0.2")) || !web.StoppedAt.Equal(stoppedAt) {
+		t.Fatalf("unexpected known service %+v", web)
+	}
+	web.Service.ParseRecords(300)
+	equalRRs(t, web.Service.DomainRecords["example"], mustRRs(t, "txt.example. 300 IN TXT \"hello\""))
+
+	// Containers that are gone are forgotten.
+	db.SetKnownServices(map[string]*KnownService{"def": known["def"]})
+	if known := db.KnownServices(); len(known) != 1 || known["def"] == nil {
+		t.Fatalf("expected only the remaining service, got %v", known)
+	}
+}
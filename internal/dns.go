@@ -2,10 +2,11 @@ package internal
 
 import (
 	"fmt"
+	"net"
 	"strings"
-	"time"
 
 	"github.com/miekg/dns"
+	"github.com/thoas/go-funk"
 )
 
 type DNSProvider struct {
@@ -40,28 +41,62 @@ func (d *DNSProvider) GetCNAMERecords(service *Service, domain string) []dns.RR
 	return rrs
 }
 
+// addressNames returns the names a service's A and AAAA records are published
+// under: its own name, its subdomains and, if enabled, a wildcard.
+func (d *DNSProvider) addressNames(service *Service, domain string) []string {
+	names := []string{fmt.Sprintf("%s.%s.", service.Name, domain)}
+	for _, sub := range service.Subdomains {
+		names = append(names, fmt.Sprintf("%s.%s.%s.", sub, service.Name, domain))
+	}
+	if service.Wildcard {
+		names = append(names, fmt.Sprintf("*.%s.%s.", service.Name, domain))
+	}
+	return names
+}
+
+// ipsFor returns the IPs of a service to publish under a domain. Domains
+// mapped to networks only get the IPs the service has on those networks.
+func (d *DNSProvider) ipsFor(service *Service, domain string) []net.IP {
+	networks := d.config.DomainNetworks(domain)
+	if networks == nil {
+		return service.IPs
+	}
+	ips := []net.IP{}
+	for _, ip := range service.IPs {
+		for _, nw := range networks {
+			if funk.Contains(service.NetworkIPs[nw], func(i net.IP) bool { return i.Equal(ip) }) {
+				ips = append(ips, ip)
+				break
+			}
+		}
+	}
+	return ips
+}
+
 func (d *DNSProvider) GetARecords(service *Service, domain string) []dns.RR {
 	rrs := []dns.RR{}
 
-	for _, ip := range service.IPs {
+	for _, name := range d.addressNames(service, domain) {
+		for _, ip := range d.ipsFor(service, domain) {
 
-		if !strings.Contains(ip.String(), ".") {
-			continue
-		}
+			if !strings.Contains(ip.String(), ".") {
+				continue
+			}
 
-		rr := new(dns.A)
+			rr := new(dns.A)
 
-		ttl := d.config.TTL
+			ttl := d.config.TTL
 
-		rr.Hdr = dns.RR_Header{
-			Name:   fmt.Sprintf("%s.%s.", service.Name, domain),
-			Rrtype: dns.TypeA,
-			Class:  dns.ClassINET,
-			Ttl:    uint32(ttl),
-		}
-		rr.A = ip
+			rr.Hdr = dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(ttl),
+			}
+			rr.A = ip
 
-		rrs = append(rrs, rr)
+			rrs = append(rrs, rr)
+		}
 	}
 
 	return rrs
@@ -70,25 +105,27 @@ func (d *DNSProvider) GetARecords(service *Service, domain string) []dns.RR {
 func (d *DNSProvider) GetAAAARecords(service *Service, domain string) []dns.RR {
 	rrs := []dns.RR{}
 
-	for _, ip := range service.IPs {
+	for _, name := range d.addressNames(service, domain) {
+		for _, ip := range d.ipsFor(service, domain) {
 
-		if !strings.Contains(ip.String(), ":") {
-			continue
-		}
+			if !strings.Contains(ip.String(), ":") {
+				continue
+			}
 
-		rr := new(dns.AAAA)
+			rr := new(dns.AAAA)
 
-		ttl := d.config.TTL
+			ttl := d.config.TTL
 
-		rr.Hdr = dns.RR_Header{
-			Name:   fmt.Sprintf("%s.%s.", service.Name, domain),
-			Rrtype: dns.TypeAAAA,
-			Class:  dns.ClassINET,
-			Ttl:    uint32(ttl),
-		}
-		rr.AAAA = ip
+			rr.Hdr = dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(ttl),
+			}
+			rr.AAAA = ip
 
-		rrs = append(rrs, rr)
+			rrs = append(rrs, rr)
+		}
 	}
 
 	return rrs
@@ -97,7 +134,7 @@ func (d *DNSProvider) GetAAAARecords(service *Service, domain string) []dns.RR {
 func (d *DNSProvider) GetPTRRecords(service *Service, domain string) []dns.RR {
 	rrs := []dns.RR{}
 
-	for _, ip := range service.IPs {
+	for _, ip := range d.ipsFor(service, domain) {
 
 		rr := new(dns.PTR)
 
@@ -122,7 +159,7 @@ func (d *DNSProvider) GetPTRRecords(service *Service, domain string) []dns.RR {
 	return rrs
 }
 
-func (s *DNSProvider) GetSOARecord(domain string) dns.RR {
+func (s *DNSProvider) GetSOARecord(domain string, serial uint32) dns.RR {
 	soa := &dns.SOA{
 		Hdr: dns.RR_Header{
 			Name:   domain + ".",
@@ -130,17 +167,145 @@ func (s *DNSProvider) GetSOARecord(domain string) dns.RR {
 			Class:  dns.ClassINET,
 			Ttl:    uint32(s.config.TTL),
 		},
-		Ns:      fmt.Sprintf("coredock.%s.", domain),
-		Mbox:    fmt.Sprintf("coredock.coredock.%s.", domain),
-		Serial:  uint32(time.Now().Truncate(time.Second).Unix()),
-		Refresh: 28800,
-		Retry:   7200,
-		Expire:  604800,
-		Minttl:  uint32(s.config.TTL),
+		Ns:      s.soaMname(domain),
+		Mbox:    s.soaMbox(domain),
+		Serial:  serial,
+		Refresh: s.config.SOARefresh,
+		Retry:   s.config.SOARetry,
+		Expire:  s.config.SOAExpire,
+		Minttl:  s.config.SOAMinimum,
 	}
 	return soa
 }
 
+// nameBase is the domain relative nameserver and mailbox names belong to.
+// Reverse zones use the first domain, ns.10.in-addr.arpa makes no sense.
+func (d *DNSProvider) nameBase(zone string) string {
+	if strings.HasSuffix(zone, ".arpa") && len(d.config.Domains) > 0 {
+		return d.config.Domains[0]
+	}
+	return zone
+}
+
+// defaultNSName is the nameserver of every zone without COREDOCK_NS_NAMES.
+const defaultNSName = "ns"
+
+func (d *DNSProvider) nsNames(zone string) []string {
+	names := []string{}
+	for _, n := range d.config.NSNames {
+		if dns.IsFqdn(n) {
+			names = append(names, n)
+		} else {
+			names = append(names, fmt.Sprintf("%s.%s.", n, d.nameBase(zone)))
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, fmt.Sprintf("%s.%s.", defaultNSName, d.nameBase(zone)))
+	}
+	return names
+}
+
+// isNSName reports whether a name is one of the zone's nameservers inside
+// the zone.
+func (d *DNSProvider) isNSName(zone string, name string) bool {
+	origin := dns.Fqdn(zone)
+	for _, ns := range d.nsNames(zone) {
+		if dns.IsSubDomain(origin, ns) && strings.EqualFold(ns, dns.Fqdn(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// soaMname is the first nameserver of the NS records.
+func (d *DNSProvider) soaMname(zone string) string {
+	return d.nsNames(zone)[0]
+}
+
+// soaMbox accepts a mail address, an absolute name or a name relative to the
+// zone, i.e. hostmaster@example.com, hostmaster.example.com. or hostmaster.
+func (d *DNSProvider) soaMbox(zone string) string {
+	mbox := d.config.SOAMbox
+	if local, domain, ok := strings.Cut(mbox, "@"); ok {
+		return dns.Fqdn(strings.ReplaceAll(local, ".", "\\.") + "." + domain)
+	}
+	if dns.IsFqdn(mbox) {
+		return mbox
+	}
+	return fmt.Sprintf("%s.%s.", mbox, d.nameBase(zone))
+}
+
+// GetApexRecords returns the NS records of a zone and the addresses of its
+// nameservers inside the zone, unless the zone already has addresses for
+// them, i.e. from COREDOCK_PUBLISH_SELF. Reverse zones get the records of the
+// forward zone their nameservers are in.
+func (d *DNSProvider) GetApexRecords(zone string, records []dns.RR) []dns.RR {
+	rrs := []dns.RR{}
+	ttl := uint32(d.config.TTL)
+	origin := dns.Fqdn(zone)
+
+	hasAddress := map[string]bool{}
+	for _, r := range records {
+		if t := r.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			hasAddress[strings.ToLower(r.Header().Name)] = true
+		}
+	}
+
+	glue := []dns.RR{}
+	for _, ns := range d.nsNames(zone) {
+		inZone := dns.IsSubDomain(origin, ns)
+		// An NS without an address makes the delegation lame. Only names
+		// coredock publishes itself are checked.
+		ours := inZone || dns.IsSubDomain(dns.Fqdn(d.nameBase(zone)), ns)
+		if ours && !hasAddress[strings.ToLower(ns)] && len(d.config.NSAddresses) == 0 {
+			warnOnce("Zone %s: Nameserver %s has no address, skipped. Set COREDOCK_NS_ADDRESSES or COREDOCK_PUBLISH_SELF", zone, ns)
+			continue
+		}
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  ns,
+		})
+		if !inZone || hasAddress[strings.ToLower(ns)] {
+			continue
+		}
+		for _, addr := range d.config.NSAddresses {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			if ip.To4() != nil {
+				glue = append(glue, &dns.A{Hdr: dns.RR_Header{Name: ns, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip})
+			} else {
+				glue = append(glue, &dns.AAAA{Hdr: dns.RR_Header{Name: ns, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}, AAAA: ip})
+			}
+		}
+	}
+	return append(rrs, glue...)
+}
+
+// IsApexRecord reports whether a record is one of the apex records added by
+// GetApexRecords, the NS records of the zone or the glue of its nameservers.
+func (d *DNSProvider) IsApexRecord(zone string, r dns.RR) bool {
+	switch rr := r.(type) {
+	case *dns.NS:
+		return strings.EqualFold(rr.Hdr.Name, dns.Fqdn(zone))
+	case *dns.A:
+		return d.isNSName(zone, rr.Hdr.Name) && d.isNSAddress(rr.A)
+	case *dns.AAAA:
+		return d.isNSName(zone, rr.Hdr.Name) && d.isNSAddress(rr.AAAA)
+	}
+	return false
+}
+
+func (d *DNSProvider) isNSAddress(ip net.IP) bool {
+	for _, addr := range d.config.NSAddresses {
+		if ip.Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *DNSProvider) createSRV(prefix string, port int, name string, domain string) dns.RR {
 	rr := new(dns.SRV)
 	ttl := d.config.TTL
@@ -171,7 +336,7 @@ func (d *DNSProvider) GetSRVRecords(service *Service, domain string) []dns.RR {
 	}
 
 	for _, srv := range service.SRVs {
-		rrs = append(rrs, d.createSRV(srv.Prefix, srv.Port, service.Name, domain))
+		rrs = append(rrs, d.createSRV(srv.Prefix, service.PublicPort(srv), service.Name, domain))
 	}
 
 	return rrs
@@ -195,3 +360,13 @@ func (d *DNSProvider) GetMXRecords(service *Service) []dns.RR {
 
 	return rrs
 }
+
+// GetRawRecords returns the coredock.record.* records of a service in a
+// domain, as parsed by Service.ParseRecords.
+func (d *DNSProvider) GetRawRecords(service *Service, domain string) []dns.RR {
+	rrs := []dns.RR{}
+	for _, rr := range service.DomainRecords[domain] {
+		rrs = append(rrs, dns.Copy(rr))
+	}
+	return rrs
+}
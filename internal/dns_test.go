@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestGetSOARecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		zone   string
+		want   string
+	}{
+		{"defaults", &Config{}, "example",
+			"example.\t300\tIN\tSOA\tns.example. hostmaster.example. 1 28800 7200 604800 300"},
+		{"reverse zones use the first domain", &Config{Domains: []string{"example"}}, "0.10.in-addr.arpa",
+			"0.10.in-addr.arpa.\t300\tIN\tSOA\tns.example. hostmaster.example. 1 28800 7200 604800 300"},
+		{"first nameserver", &Config{NSNames: []string{"ns1", "ns2.example.com."}}, "example",
+			"example.\t300\tIN\tSOA\tns1.example. hostmaster.example. 1 28800 7200 604800 300"},
+		{"absolute nameserver and mail address", &Config{NSNames: []string{"ns.example.com."}, SOAMbox: "dns.admin@example.com"}, "example",
+			"example.\t300\tIN\tSOA\tns.example.com. dns\\.admin.example.com. 1 28800 7200 604800 300"},
+		{"timers", &Config{SOARefresh: 3600, SOARetry: 600, SOAExpire: 86400, SOAMinimum: 60}, "example",
+			"example.\t300\tIN\tSOA\tns.example. hostmaster.example. 1 3600 600 86400 60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{TTL: 300, SOAMbox: "hostmaster", SOARefresh: 28800, SOARetry: 7200, SOAExpire: 604800, SOAMinimum: 300}
+			c.Domains, c.NSNames = tt.config.Domains, tt.config.NSNames
+			if tt.config.SOAMbox != "" {
+				c.SOAMbox = tt.config.SOAMbox
+			}
+			if tt.config.SOARefresh != 0 {
+				c.SOARefresh, c.SOARetry, c.SOAExpire, c.SOAMinimum = tt.config.SOARefresh, tt.config.SOARetry, tt.config.SOAExpire, tt.config.SOAMinimum
+			}
+			if got := NewDNSProvider(c).GetSOARecord(tt.zone, 1).String(); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetApexRecords(t *testing.T) {
+	records := mustRRs(t, "web.example. 300 IN A 10.0.0.2")
+	tests := []struct {
+		name    string
+		config  *Config
+		records []dns.RR
+		want    []string
+	}{
+		{"nameserver without an address is skipped", &Config{}, records, nil},
+		{"glue", &Config{NSAddresses: []string{"10.0.0.53", "fd00::53"}}, records, []string{
+			"example. 300 IN NS ns.example.",
+			"ns.example. 300 IN A 10.0.0.53",
+			"ns.example. 300 IN AAAA fd00::53",
+		}},
+		{"published nameserver needs no glue", &Config{NSAddresses: []string{"10.0.0.53"}},
+			append(mustRRs(t, "ns.example. 300 IN A 172.17.0.2"), records...), []string{"example. 300 IN NS ns.example."}},
+		{"external nameservers", &Config{NSNames: []string{"ns", "ns.example.com."}}, records, []string{
+			"example. 300 IN NS ns.example.com.",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.TTL = 300
+			equalRRs(t, NewDNSProvider(tt.config).GetApexRecords("example", tt.records), mustRRs(t, tt.want...))
+		})
+	}
+}
+
+func TestIsApexRecord(t *testing.T) {
+	d := NewDNSProvider(&Config{TTL: 300, NSAddresses: []string{"10.0.0.53"}})
+	tests := []struct {
+		record string
+		apex   bool
+	}{
+		{"example. 300 IN NS ns.example.", true},
+		{"sub.example. 300 IN NS ns.sub.example.", false},
+		{"ns.example. 300 IN A 10.0.0.53", true},
+		{"ns.example. 300 IN A 172.17.0.2", false},
+		{"web.example. 300 IN A 10.0.0.53", false},
+	}
+	for _, tt := range tests {
+		if got := d.IsApexRecord("example", mustRR(t, tt.record)); got != tt.apex {
+			t.Errorf("IsApexRecord(%s) = %v, want %v", tt.record, got, tt.apex)
+		}
+	}
+}
+
+func TestSOAChangesBumpSerial(t *testing.T) {
+	config := &Config{TTL: 300, SOAMbox: "hostmaster", SOARefresh: 28800}
+	z := NewZoneHandler(config, newTestDB(t), nil)
+	records := mustRRs(t, "web.example. 300 IN A 10.0.0.2")
+
+	first := z.buildZone("example", "example", records, NewDNSProvider(config))
+	config.SOAMbox = "dns@example.com"
+	second := z.buildZone("example", "example", records, NewDNSProvider(config))
+	if !second.Changed || second.SOA.(*dns.SOA).Serial <= first.SOA.(*dns.SOA).Serial {
+		t.Fatalf("expected a new mailbox to bump the serial")
+	}
+	config.SOARefresh = 3600
+	if third := z.buildZone("example", "example", records, NewDNSProvider(config)); !third.Changed {
+		t.Fatalf("expected a new refresh timer to change the zone")
+	}
+}
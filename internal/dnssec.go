@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	signatureValidity = 21 * 24 * time.Hour
+	signatureRefresh  = 7 * 24 * time.Hour
+)
+
+type signingKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+type signedZone struct {
+	serial   uint32
+	signedAt time.Time
+	records  []dns.RR
+}
+
+// Signer signs zones online with a KSK and a ZSK per zone. Keys are created
+// on first use and kept in <data dir>/keys in BIND format, next to a
+// dsset-<zone>. file with the DS records for the parent zone.
+type Signer struct {
+	config *Config
+	keys   map[string][]*signingKey
+	cache  map[string]*signedZone
+	mux    sync.Mutex
+}
+
+func NewSigner(config *Config) *Signer {
+	if !config.DNSSEC {
+		return nil
+	}
+	return &Signer{config: config, keys: map[string][]*signingKey{}, cache: map[string]*signedZone{}}
+}
+
+func (s *Signer) keyDir() string {
+	return filepath.Join(s.config.DataDir, "keys")
+}
+
+// NeedsResign reports whether the signatures of a zone are about to expire,
+// which requires a new serial even if the records did not change.
+func (s *Signer) NeedsResign(signedAt time.Time) bool {
+	return time.Since(signedAt) > signatureRefresh
+}
+
+// ResignInterval is how often zones need to be built even without changes,
+// so their signatures are refreshed long before they expire.
+func (s *Signer) ResignInterval() time.Duration {
+	return signatureRefresh / 2
+}
+
+// Sign returns the records of a zone together with its DNSKEY, NSEC and RRSIG
+// records. Zones are only signed again if their serial changed. Signatures
+// are cached by key, views of a zone share its keys.
+func (s *Signer) Sign(key string, zone string, soa dns.RR, records []dns.RR) ([]dns.RR, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	serial := soa.(*dns.SOA).Serial
+	if cached, ok := s.cache[key]; ok && cached.serial == serial {
+		return cached.records, nil
+	}
+
+	keys, err := s.loadKeys(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	origin := dns.Fqdn(zone)
+	minTTL := soa.(*dns.SOA).Minttl
+
+	all := append([]dns.RR{soa}, records...)
+	for _, k := range keys {
+		k.key.Hdr.Ttl = soa.Header().Ttl
+		all = append(all, k.key)
+	}
+	all = append(all, nsecChain(origin, all, minTTL)...)
+
+	now := time.Now().UTC()
+	signed := []dns.RR{}
+	for _, rrset := range groupRRsets(all) {
+		for _, k := range keys {
+			isKSK := k.key.Flags == 257
+			if isKSK != (rrset[0].Header().Rrtype == dns.TypeDNSKEY) {
+				continue
+			}
+			sig := &dns.RRSIG{
+				Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+				Algorithm:  k.key.Algorithm,
+				Inception:  uint32(now.Add(-time.Hour).Unix()),
+				Expiration: uint32(now.Add(signatureValidity).Unix()),
+				KeyTag:     k.key.KeyTag(),
+				SignerName: origin,
+			}
+			if err := sig.Sign(k.priv, rrset); err != nil {
+				return nil, fmt.Errorf("error signing %s %s: %w", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype], err)
+			}
+			signed = append(signed, sig)
+		}
+	}
+
+	// The SOA is written separately by the sinks, everything else is returned.
+	result := append([]dns.RR{}, all[1:]...)
+	result = append(result, signed...)
+
+	s.cache[key] = &signedZone{serial: serial, signedAt: now, records: result}
+	logger.Debugf("DNSSEC: Signed zone %s serial %d", key, serial)
+	return result, nil
+}
+
+func (s *Signer) Forget(key string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.cache, key)
+}
+
+func (s *Signer) loadKeys(zone string) ([]*signingKey, error) {
+	if keys, ok := s.keys[zone]; ok {
+		return keys, nil
+	}
+
+	if err := os.MkdirAll(s.keyDir(), 0o700); err != nil {
+		return nil, fmt.Errorf("error creating key directory: %w", err)
+	}
+
+	origin := dns.Fqdn(zone)
+	files, _ := filepath.Glob(filepath.Join(s.keyDir(), "K"+origin+"+*.key"))
+	keys := []*signingKey{}
+	for _, f := range files {
+		k, err := readSigningKey(f)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	hasKSK, hasZSK := false, false
+	for _, k := range keys {
+		hasKSK = hasKSK || k.key.Flags == 257
+		hasZSK = hasZSK || k.key.Flags == 256
+	}
+	for flags, present := range map[uint16]bool{257: hasKSK, 256: hasZSK} {
+		if present {
+			continue
+		}
+		k, err := s.generateKey(origin, flags)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key.KeyTag() < keys[j].key.KeyTag() })
+	if err := s.writeDSSet(origin, keys); err != nil {
+		return nil, err
+	}
+
+	s.keys[zone] = keys
+	return keys, nil
+}
+
+func (s *Signer) generateKey(origin string, flags uint16) (*signingKey, error) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		return nil, fmt.Errorf("error generating key for %s: %w", origin, err)
+	}
+
+	base := filepath.Join(s.keyDir(), fmt.Sprintf("K%s+%03d+%05d", origin, key.Algorithm, key.KeyTag()))
+	if err := writeFileAtomic(base+".private", []byte(key.PrivateKeyString(priv)), 0o600); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(base+".key", []byte(key.String()+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+
+	kind := "ZSK"
+	if flags == 257 {
+		kind = "KSK"
+	}
+	logger.Infof("DNSSEC: Generated %s %d for %s", kind, key.KeyTag(), origin)
+	return &signingKey{key: key, priv: priv.(crypto.Signer)}, nil
+}
+
+func (s *Signer) writeDSSet(origin string, keys []*signingKey) error {
+	contents := ""
+	for _, k := range keys {
+		if k.key.Flags != 257 {
+			continue
+		}
+		ds := k.key.ToDS(dns.SHA256)
+		contents += ds.String() + "\n"
+		logger.Infof("DNSSEC: Add this DS record to the parent of %s: %s", origin, ds)
+	}
+	return writeFileIfChanged(filepath.Join(s.keyDir(), "dsset-"+origin), []byte(contents))
+}
+
+func readSigningKey(path string) (*signingKey, error) {
+	pub, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rr, err := dns.NewRR(string(pub))
+	if err != nil {
+		return nil, fmt.Errorf("error reading key %s: %w", path, err)
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain a DNSKEY", path)
+	}
+
+	privPath := strings.TrimSuffix(path, ".key") + ".private"
+	f, err := os.Open(privPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	priv, err := key.ReadPrivateKey(f, privPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key %s: %w", privPath, err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key in %s", privPath)
+	}
+	return &signingKey{key: key, priv: signer}, nil
+}
+
+func groupRRsets(records []dns.RR) [][]dns.RR {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	order := []rrsetKey{}
+	sets := map[rrsetKey][]dns.RR{}
+	for _, r := range records {
+		k := rrsetKey{strings.ToLower(r.Header().Name), r.Header().Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], r)
+	}
+	rrsets := [][]dns.RR{}
+	for _, k := range order {
+		rrsets = append(rrsets, sets[k])
+	}
+	return rrsets
+}
+
+// nsecChain links all owner names of a zone in canonical order.
+func nsecChain(origin string, records []dns.RR, ttl uint32) []dns.RR {
+	types := map[string][]uint16{}
+	for _, r := range records {
+		name := strings.ToLower(r.Header().Name)
+		types[name] = append(types[name], r.Header().Rrtype)
+	}
+
+	names := []string{}
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalLess(names[i], names[j]) })
+
+	nsecs := []dns.RR{}
+	for i, name := range names {
+		bitmap := append(types[name], dns.TypeNSEC, dns.TypeRRSIG)
+		sort.Slice(bitmap, func(a, b int) bool { return bitmap[a] < bitmap[b] })
+		unique := []uint16{}
+		for _, t := range bitmap {
+			if len(unique) == 0 || unique[len(unique)-1] != t {
+				unique = append(unique, t)
+			}
+		}
+		nsecs = append(nsecs, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: unique,
+		})
+	}
+	if len(nsecs) > 0 && names[0] != strings.ToLower(origin) {
+		logger.Warnf("DNSSEC: Zone %s has no records at its apex", origin)
+	}
+	return nsecs
+}
+
+// canonicalLess implements the canonical DNS name order from RFC 4034,
+// comparing labels from right to left.
+func canonicalLess(a string, b string) bool {
+	la := dns.SplitDomainName(a)
+	lb := dns.SplitDomainName(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x := strings.ToLower(la[len(la)-i])
+		y := strings.ToLower(lb[len(lb)-i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testSigner(t *testing.T, dir string) *Signer {
+	t.Helper()
+	return NewSigner(&Config{DNSSEC: true, DataDir: dir})
+}
+
+func TestSign(t *testing.T) {
+	signer := testSigner(t, t.TempDir())
+	soa := testSOA(t, 1)
+	records := mustRRs(t,
+		"example. 300 IN NS ns.example.",
+		"ns.example. 300 IN A 10.0.0.53",
+		"web.example. 300 IN A 10.0.0.2",
+		"*.web.example. 300 IN A 10.0.0.2",
+		"api.web.example. 300 IN A 10.0.0.3",
+		"www.example. 300 IN CNAME web.example.",
+	)
+
+	signed, err := signer.Sign("example", "example", soa, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[uint16]*dns.DNSKEY{}
+	sigs := map[string][]*dns.RRSIG{}
+	nsecs := []*dns.NSEC{}
+	unsigned := []dns.RR{soa}
+	for _, rr := range signed {
+		switch r := rr.(type) {
+		case *dns.DNSKEY:
+			keys[r.KeyTag()] = r
+		case *dns.RRSIG:
+			sigs[r.Hdr.Name+"/"+dns.TypeToString[r.TypeCovered]] = append(sigs[r.Hdr.Name+"/"+dns.TypeToString[r.TypeCovered]], r)
+			continue
+		case *dns.NSEC:
+			nsecs = append(nsecs, r)
+		}
+		unsigned = append(unsigned, rr)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected a KSK and a ZSK, got %d keys", len(keys))
+	}
+
+	// Every RRset has one valid signature, DNSKEYs by the KSK, everything
+	// else by the ZSK.
+	for _, rrset := range groupRRsets(unsigned) {
+		name := rrset[0].Header().Name + "/" + dns.TypeToString[rrset[0].Header().Rrtype]
+		if len(sigs[name]) != 1 {
+			t.Fatalf("expected one RRSIG for %s, got %d", name, len(sigs[name]))
+		}
+		sig := sigs[name][0]
+		key, ok := keys[sig.KeyTag]
+		if !ok {
+			t.Fatalf("RRSIG for %s is signed by unknown key %d", name, sig.KeyTag)
+		}
+		if isKSK := key.Flags == 257; isKSK != (rrset[0].Header().Rrtype == dns.TypeDNSKEY) {
+			t.Errorf("RRSIG for %s is signed by the wrong key (flags %d)", name, key.Flags)
+		}
+		if err := sig.Verify(key, rrset); err != nil {
+			t.Errorf("RRSIG for %s does not verify: %v", name, err)
+		}
+		if !sig.ValidityPeriod(time.Now()) || !sig.ValidityPeriod(time.Now().Add(signatureValidity-time.Hour)) {
+			t.Errorf("RRSIG for %s is not valid for %s", name, signatureValidity)
+		}
+	}
+
+	// NSEC records link all names in canonical order, wildcards included.
+	want := []string{"example.", "ns.example.", "web.example.", "*.web.example.", "api.web.example.", "www.example."}
+	if len(nsecs) != len(want) {
+		t.Fatalf("expected %d NSEC records, got %d", len(want), len(nsecs))
+	}
+	for i, nsec := range nsecs {
+		if nsec.Hdr.Name != want[i] {
+			t.Errorf("NSEC %d: expected owner %s, got %s", i, want[i], nsec.Hdr.Name)
+		}
+		if next := want[(i+1)%len(want)]; nsec.NextDomain != next {
+			t.Errorf("NSEC of %s: expected next %s, got %s", nsec.Hdr.Name, next, nsec.NextDomain)
+		}
+	}
+	bitmap := func(types ...uint16) string { return (&dns.NSEC{TypeBitMap: types}).String() }
+	if got := bitmap(nsecs[0].TypeBitMap...); got != bitmap(dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY) {
+		t.Errorf("unexpected apex types %s", got)
+	}
+	if got := bitmap(nsecs[3].TypeBitMap...); got != bitmap(dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC) {
+		t.Errorf("unexpected wildcard types %s", got)
+	}
+}
+
+func TestSignerKeepsKeys(t *testing.T) {
+	dir := t.TempDir()
+	first, err := testSigner(t, dir).loadKeys("example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := testSigner(t, dir).loadKeys("example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || len(second) != 2 {
+		t.Fatalf("expected two keys, got %d and %d", len(first), len(second))
+	}
+	for i := range first {
+		if first[i].key.KeyTag() != second[i].key.KeyTag() {
+			t.Errorf("key %d changed from %d to %d", i, first[i].key.KeyTag(), second[i].key.KeyTag())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keys", "dsset-example.")); err != nil {
+		t.Errorf("expected a dsset file: %v", err)
+	}
+}
+
+func TestCanonicalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"example.", "a.example.", true},
+		{"a.example.", "example.", false},
+		{"a.example.", "B.example.", true},
+		{"*.web.example.", "a.web.example.", true},
+		{"web.example.", "*.web.example.", true},
+		{"z.example.", "a.z.example.", true},
+		{"a.z.example.", "zz.example.", true},
+		{"yljkjljk.a.example.", "Z.a.example.", true},
+	}
+	for _, tt := range tests {
+		if got := canonicalLess(tt.a, tt.b); got != tt.less {
+			t.Errorf("canonicalLess(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.less)
+		}
+	}
+}
+
+func TestQuietZonesAreResigned(t *testing.T) {
+	config := &Config{DNSSEC: true, DataDir: t.TempDir(), TTL: 300, SOAMbox: "hostmaster"}
+	db := newTestDB(t)
+	z := NewZoneHandler(config, db, nil)
+	d := NewDNSProvider(config)
+	records := mustRRs(t, "web.example. 300 IN A 10.0.0.2")
+
+	first := z.buildZone("example", "example", records, d)
+	if !first.Changed {
+		t.Fatalf("expected a new zone to be changed")
+	}
+	if again := z.buildZone("example", "example", records, d); again.Changed {
+		t.Fatalf("expected an unchanged zone with fresh signatures to stay unchanged")
+	}
+
+	state := db.ZoneState("example")
+	state.SignedAt = time.Now().Add(-signatureRefresh - time.Hour)
+	db.SetZoneState("example", state)
+
+	resigned := z.buildZone("example", "example", records, d)
+	if !resigned.Changed {
+		t.Fatalf("expected old signatures to be refreshed")
+	}
+	if resigned.SOA.(*dns.SOA).Serial <= first.SOA.(*dns.SOA).Serial {
+		t.Fatalf("expected a new serial after refreshing signatures")
+	}
+	if z.ResignInterval() <= 0 || z.ResignInterval() >= signatureValidity-signatureRefresh {
+		t.Fatalf("resign interval %s doesn't refresh signatures in time", z.ResignInterval())
+	}
+}
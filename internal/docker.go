@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +24,11 @@ type DockerClient struct {
 	db            *DB
 	config        *Config
 	previousNames []string
+	pinConflicts  map[string]string
+	hostname      string
+	lastKnown     map[string]*KnownService
+	savedKnown    string
+	self          string
 	mux           sync.Mutex
 }
 
@@ -31,26 +37,93 @@ func NewDockerClient(channel chan *[]Service, conf *Config, db *DB) (*DockerClie
 	if err != nil {
 		return nil, err
 	}
-	return &DockerClient{client: client, channel: channel, config: conf, db: db, previousNames: []string{}, mux: sync.Mutex{}}, nil
+	self := detectSelf(conf)
+	if self == "" {
+		logger.Warnf("Could not detect coredock's own container, set COREDOCK_SELF to its name or ID")
+	} else {
+		logger.Debugf("Running in container %s", self)
+	}
+	// The last known services survive restarts, so stopped containers
+	// keep their records.
+	lastKnown := db.KnownServices()
+	for _, known := range lastKnown {
+		known.Service.ParseRecords(conf.TTL)
+	}
+	saved, _ := json.Marshal(lastKnown)
+	savedKnown := string(saved)
+	conf.HostNetwork = inHostNetwork(client, self)
+	if !conf.HostNetwork && len(conf.HostIPs) == 0 {
+		logger.Warnf("coredock doesn't run with network_mode: host, set COREDOCK_HOST_IPS to publish containers in the host network")
+	}
+	return &DockerClient{client: client, channel: channel, config: conf, db: db, previousNames: []string{}, pinConflicts: map[string]string{}, lastKnown: lastKnown, savedKnown: savedKnown, self: self, mux: sync.Mutex{}}, nil
 }
 
 func (d *DockerClient) sendContainers() {
 	d.mux.Lock()
+	d.reconcileAttachments()
 	containers, err := d.getContainers()
 	if err != nil {
+		logger.Errorf("%v", err)
+		d.mux.Unlock()
 		return
 	}
 
 	services := []Service{}
+	existing := map[string]bool{}
+	pinned := map[string]bool{}
 	for _, c := range containers {
-		d.maybeConnectToNetwork(&c)
-		services = append(services, *NewService(&c, "start", d.config))
+		existing[c.ID] = true
+		for nw := range ParsePinnedIPs(c.Labels) {
+			pinned[cleanContainerName(c.Names[0])+"/"+nw] = true
+		}
+		if isSelf(d.self, &c) {
+			if d.config.PublishSelf && c.State == "running" {
+				services = append(services, NewSelfServices(&c, d.config)...)
+			}
+			continue
+		}
+		if c.State != "running" {
+			if s := d.stoppedService(&c); s != nil {
+				services = append(services, *s)
+			}
+			continue
+		}
+		// Containers in the host network can't join other networks.
+		if !IsHostNetwork(&c) {
+			d.maybeConnectToNetwork(&c)
+		}
+		// Not yet healthy containers are connected, but not published.
+		if health := healthStatus(&c); health != "" && health != "healthy" && d.requiresHealthy(&c) {
+			logger.Debugf("Withdrawing container '%s', it is %s", cleanContainerName(c.Names[0]), health)
+			delete(d.lastKnown, c.ID)
+			continue
+		}
+		s := NewService(&c, "start", d.config)
+		services = append(services, *s)
+		d.lastKnown[c.ID] = &KnownService{Service: *s}
+	}
+	for id := range d.lastKnown {
+		if !existing[id] {
+			delete(d.lastKnown, id)
+		}
+	}
+	for key := range d.pinConflicts {
+		if !pinned[key] {
+			delete(d.pinConflicts, key)
+		}
+	}
+	if known, err := json.Marshal(d.lastKnown); err == nil && string(known) != d.savedKnown {
+		d.db.SetKnownServices(d.lastKnown)
+		d.savedKnown = string(known)
+	}
+	if d.config.PublishHost {
+		if hostname := d.hostName(); hostname != "" {
+			services = append(services, *NewHostService(hostname, d.config))
+		}
 	}
 
+	// IPs are in their published order, so a new order is a change as well.
 	currentNames := funk.Map(services, func(s Service) string {
-		sort.Slice(s.IPs, func(i, j int) bool {
-			return bytes.Compare(s.IPs[i], s.IPs[j]) < 0
-		})
 		return fmt.Sprintf("%s%v", s.Name, s.IPs)
 	}).([]string)
 
@@ -72,6 +145,21 @@ func (d *DockerClient) sendContainers() {
 	d.mux.Unlock()
 }
 
+func (d *DockerClient) hostName() string {
+	if d.config.HostName != "" {
+		return d.config.HostName
+	}
+	if d.hostname == "" {
+		info, err := d.client.Info()
+		if err != nil {
+			logger.Errorf("Error getting Docker host name: %v", err)
+			return ""
+		}
+		d.hostname, _, _ = strings.Cut(info.Name, ".")
+	}
+	return d.hostname
+}
+
 func debounce(fn func(), delay time.Duration) func() {
 	var timer *time.Timer
 	var mu sync.Mutex
@@ -100,6 +188,13 @@ func (d *DockerClient) Run() error {
 		}
 	}()
 
+	go func() {
+		for {
+			d.db.CollectGarbage()
+			time.Sleep(time.Hour)
+		}
+	}()
+
 	err := d.client.AddEventListener(dockerChan)
 	if err != nil {
 		return fmt.Errorf("error adding Docker event listener: %w", err)
@@ -108,9 +203,9 @@ func (d *DockerClient) Run() error {
 	for e := range dockerChan {
 
 		logger.Debugf("Received event from Docker: %v", e)
-		actions := []string{"create", "connect", "disconnect", "destroy", "start", "stop"}
+		actions := []string{"create", "connect", "disconnect", "destroy", "start", "stop", "restart", "pause", "unpause", "die", "kill"}
 
-		if funk.Contains(actions, e.Action) {
+		if funk.Contains(actions, e.Action) || strings.HasPrefix(e.Action, "health_status") {
 			debounce(d.sendContainers, 5*time.Second)()
 		}
 
@@ -131,12 +226,93 @@ func (d *DockerClient) getContainers() ([]docker.APIContainers, error) {
 			logger.Debugf("Ignoring container '%s' due to 'coredock.ignore' label", cleanContainerName(c.Names[0]))
 		}
 
-		isCoredock := strings.Contains(c.Image, "coredock")
+		return !isIgnored
+	}).([]docker.APIContainers), nil
+}
+
+// stoppedService returns the last known service of a container that is not
+// running anymore, if it should be kept by COREDOCK_STOPPED_GRACE or its
+// coredock.keep_when_stopped label.
+func (d *DockerClient) stoppedService(c *docker.APIContainers) *Service {
+	known, ok := d.lastKnown[c.ID]
+	if !ok {
+		return nil
+	}
+	name := cleanContainerName(c.Names[0])
+	keep := d.keepWhenStopped(c)
+	if keep == 0 {
+		delete(d.lastKnown, c.ID)
+		return nil
+	}
+	if known.StoppedAt.IsZero() {
+		known.StoppedAt = time.Now()
+		logger.Infof("Keeping records of container '%s' while it is %s", name, c.State)
+	}
+	if keep > 0 && time.Since(known.StoppedAt) > keep {
+		logger.Infof("Container '%s' is %s for more than %s, removing its records", name, c.State, keep)
+		delete(d.lastKnown, c.ID)
+		return nil
+	}
+	s := known.Service
+	s.Action = c.State
+	return &s
+}
+
+// keepWhenStopped returns how long to keep the records of a stopped
+// container, 0 for not at all and -1 for as long as the container exists.
+func (d *DockerClient) keepWhenStopped(c *docker.APIContainers) time.Duration {
+	if v, ok := c.Labels["coredock.keep_when_stopped"]; ok {
+		keep, err := parseKeepWhenStopped(v)
+		if err == nil {
+			return keep
+		}
+	}
+	return d.config.StoppedGrace
+}
+
+// parseKeepWhenStopped accepts true, false, seconds or a duration. true is
+// returned as -1, negative durations are invalid.
+func parseKeepWhenStopped(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	if b, err := strconv.ParseBool(v); err == nil {
+		if b {
+			return -1, nil
+		}
+		return 0, nil
+	}
+	keep, err := time.ParseDuration(v)
+	if secs, serr := strconv.Atoi(v); serr == nil {
+		keep, err = time.Duration(secs)*time.Second, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if keep < 0 {
+		return 0, fmt.Errorf("negative duration %s", v)
+	}
+	return keep, nil
+}
 
-		isRunning := c.State == "running"
+// healthStatus reads the health of a container from its status, i.e.
+// "Up 2 minutes (healthy)". Containers without a healthcheck return "".
+func healthStatus(c *docker.APIContainers) string {
+	switch {
+	case strings.HasSuffix(c.Status, "(healthy)"):
+		return "healthy"
+	case strings.HasSuffix(c.Status, "(unhealthy)"):
+		return "unhealthy"
+	case strings.HasSuffix(c.Status, "(health: starting)"):
+		return "starting"
+	}
+	return ""
+}
 
-		return !isIgnored && !isCoredock && isRunning
-	}).([]docker.APIContainers), nil
+func (d *DockerClient) requiresHealthy(c *docker.APIContainers) bool {
+	if v, ok := c.Labels["coredock.require_healthy"]; ok {
+		required, err := strconv.ParseBool(strings.TrimSpace(v))
+		return err == nil && required
+	}
+	return d.config.RequireHealthy
 }
 
 func (d *DockerClient) connectWithPriority(networkID, containerID string, ipv4, ipv6 string) error {
@@ -207,7 +383,7 @@ func (d *DockerClient) isIPAssignedOnNetwork(networkName, ip string) (bool, stri
 	}
 	for _, c := range containers {
 		for nwName, nw := range c.Networks.Networks {
-			if nwName == networkName && nw.IPAddress == ip {
+			if nwName == networkName && (nw.IPAddress == ip || nw.GlobalIPv6Address == ip) {
 				return true, cleanContainerName(c.Names[0])
 			}
 		}
@@ -226,27 +402,43 @@ func (d *DockerClient) isConnectedToNetwork(c *docker.APIContainers, networkID s
 
 func (d *DockerClient) maybeConnectToNetwork(c *docker.APIContainers) {
 	containerName := cleanContainerName(c.Names[0])
-	for _, nw := range d.config.Networks {
+	pins := ParsePinnedIPs(c.Labels)
+
+	networks := append([]string{}, d.config.Networks...)
+	for nw := range pins {
+		if !funk.ContainsString(networks, nw) {
+			networks = append(networks, nw)
+		}
+	}
+	sort.Strings(networks[len(d.config.Networks):])
+
+	for _, nw := range networks {
 
 		dnw, err := d.findNetwork(nw)
 		if err != nil {
 			logger.Errorf("Error finding network '%s': %v", nw, err)
 			continue
 		}
+
+		if pin, ok := pins[nw]; ok {
+			d.pinToNetwork(c, dnw, pin)
+			continue
+		}
+
 		if d.isConnectedToNetwork(c, dnw.ID) {
 			logger.Debugf("Container '%s' already connected to network '%s'", containerName, dnw.Name)
 			d.saveIp(c, dnw)
 			continue
 		}
 
-		dbKey := fmt.Sprintf("%s-%s", containerName, dnw.Name)
 		containerIPv4 := ""
 		containerIPv6 := ""
 
 		if d.config.ReuseIPs {
-
-			containerIPv4 = d.db.Get(dbKey + ":ipv4")
-			containerIPv6 = d.db.Get(dbKey + ":ipv6")
+			if r := d.db.Reservation(containerName, dnw.Name); r != nil {
+				containerIPv4 = r.IPv4
+				containerIPv6 = r.IPv6
+			}
 			logger.Debugf("container ipv4: %s ipv6: %s", containerIPv4, containerIPv6)
 			if containerIPv4 != "" {
 				assigned, assignedTo := d.isIPAssignedOnNetwork(dnw.Name, containerIPv4)
@@ -266,34 +458,161 @@ func (d *DockerClient) maybeConnectToNetwork(c *docker.APIContainers) {
 			}
 		}
 
-		if dnw.Driver == "macvlan" {
-			err = d.connectMacvlanWithConflictHandling(c, dnw, containerIPv4, containerIPv6)
-		} else {
-			opts := docker.NetworkConnectionOptions{
-				Container: c.ID,
-			}
-			if containerIPv4 != "" || containerIPv6 != "" {
-				ipam := &docker.EndpointIPAMConfig{}
-				if containerIPv4 != "" {
-					ipam.IPv4Address = containerIPv4
-				}
-				if containerIPv6 != "" {
-					ipam.IPv6Address = containerIPv6
-				}
-				opts.EndpointConfig = &docker.EndpointConfig{
-					IPAMConfig: ipam,
-				}
-			}
-			err = d.client.ConnectNetwork(dnw.ID, opts)
-		}
+		err = d.connectToNetwork(c, dnw, containerIPv4, containerIPv6)
 
 		if err != nil {
 			logger.Errorf("Error connecting container '%s' to %s network '%s': %v", cleanContainerName(c.Names[0]), dnw.Driver, dnw.Name, err)
 		} else {
 			logger.Debugf("Connected '%s' to network '%s'", containerName, dnw.Name)
+			d.db.AddAttachment(c.ID, dnw.Name)
+		}
+	}
+
+}
+
+func (d *DockerClient) connectToNetwork(c *docker.APIContainers, dnw *docker.Network, ipv4, ipv6 string) error {
+	if dnw.Driver == "macvlan" {
+		return d.connectMacvlanWithConflictHandling(c, dnw, ipv4, ipv6)
+	}
+
+	opts := docker.NetworkConnectionOptions{
+		Container: c.ID,
+	}
+	if ipv4 != "" || ipv6 != "" {
+		ipam := &docker.EndpointIPAMConfig{}
+		if ipv4 != "" {
+			ipam.IPv4Address = ipv4
+		}
+		if ipv6 != "" {
+			ipam.IPv6Address = ipv6
+		}
+		opts.EndpointConfig = &docker.EndpointConfig{
+			IPAMConfig: ipam,
+		}
+	}
+	return d.client.ConnectNetwork(dnw.ID, opts)
+}
+
+// pinToNetwork makes sure a container holds the IPs from its coredock.ipv4.<network>
+// and coredock.ipv6.<network> labels. Addresses held by other containers are
+// never taken away; the pin is retried on every sync until they are released.
+func (d *DockerClient) pinToNetwork(c *docker.APIContainers, dnw *docker.Network, pin *PinnedIP) {
+	containerName := cleanContainerName(c.Names[0])
+	key := containerName + "/" + dnw.Name
+
+	if err := pin.Validate(dnw); err != nil {
+		d.warnPinConflict(key, fmt.Sprintf("Ignoring pinned IP of '%s' on network '%s': %v", containerName, dnw.Name, err))
+		return
+	}
+
+	current, connected := c.Networks.Networks[dnw.Name]
+	if connected && pin.Matches(current.IPAddress, current.GlobalIPv6Address) {
+		logger.Debugf("Container '%s' already holds its pinned IP on network '%s'", containerName, dnw.Name)
+		d.saveIp(c, dnw)
+		d.resolvePinConflict(key)
+		return
+	}
+
+	for _, ip := range []string{pin.IPv4, pin.IPv6} {
+		if ip == "" {
+			continue
+		}
+		if assigned, assignedTo := d.isIPAssignedOnNetwork(dnw.Name, ip); assigned && assignedTo != containerName {
+			d.warnPinConflict(key, fmt.Sprintf("Pinned IP '%s' of '%s' on network '%s' is held by '%s', retrying once it is released", ip, containerName, dnw.Name, assignedTo))
+			return
+		}
+	}
+
+	// Only attachments coredock made itself are replaced, networks from compose
+	// or the user keep the address they were given.
+	if connected && !d.db.HasAttachment(c.ID, dnw.Name) {
+		d.warnPinConflict(key, fmt.Sprintf("Pinned IP %s of '%s' on network '%s' differs from its address %s, but the network was not attached by coredock. Set the address where the network is attached instead", pin, containerName, dnw.Name, (&PinnedIP{IPv4: current.IPAddress, IPv6: current.GlobalIPv6Address}).String()))
+		return
+	}
+
+	if connected {
+		if err := d.disconnectFromNetwork(c.ID, dnw.ID); err != nil {
+			logger.Errorf("Error disconnecting '%s' from network '%s' to apply its pinned IP: %v", containerName, dnw.Name, err)
+			return
+		}
+	}
+
+	if err := d.connectToNetwork(c, dnw, pin.IPv4, pin.IPv6); err != nil {
+		logger.Errorf("Error connecting container '%s' to %s network '%s' with pinned IP: %v", containerName, dnw.Driver, dnw.Name, err)
+		if connected {
+			d.connectToNetwork(c, dnw, current.IPAddress, current.GlobalIPv6Address)
 		}
+		return
+	}
+
+	logger.Infof("Connected '%s' to network '%s' with pinned IP %s", containerName, dnw.Name, pin)
+	if !connected {
+		d.db.AddAttachment(c.ID, dnw.Name)
+	}
+	d.db.Reserve(containerName, dnw.Name, pin.IPv4, pin.IPv6)
+	d.resolvePinConflict(key)
+}
+
+func (d *DockerClient) warnPinConflict(key string, msg string) {
+	if d.pinConflicts[key] == msg {
+		logger.Debugf("%s", msg)
+		return
+	}
+	d.pinConflicts[key] = msg
+	logger.Warnf("%s", msg)
+}
+
+func (d *DockerClient) resolvePinConflict(key string) {
+	if _, ok := d.pinConflicts[key]; ok {
+		logger.Infof("Pinned IP conflict for '%s' resolved", key)
+		delete(d.pinConflicts, key)
+	}
+}
+
+func (d *DockerClient) reconcileAttachments() {
+	attachments := d.db.Attachments()
+	if len(attachments) == 0 {
+		return
 	}
 
+	containers, err := d.client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		logger.Errorf("Error reconciling network attachments: %v", err)
+		return
+	}
+	byID := map[string]docker.APIContainers{}
+	for _, c := range containers {
+		byID[c.ID] = c
+	}
+
+	for containerID, networks := range attachments {
+		c, exists := byID[containerID]
+		for _, nw := range networks {
+			if !exists {
+				d.db.RemoveAttachment(containerID, nw)
+				continue
+			}
+			if _, connected := c.Networks.Networks[nw]; !connected {
+				// Detached by someone else, forget about it.
+				d.db.RemoveAttachment(containerID, nw)
+				continue
+			}
+
+			_, isIgnored := c.Labels["coredock.ignore"]
+			_, isPinned := ParsePinnedIPs(c.Labels)[nw]
+			if !isIgnored && (funk.ContainsString(d.config.Networks, nw) || isPinned) {
+				continue
+			}
+
+			containerName := cleanContainerName(c.Names[0])
+			if err := d.disconnectFromNetwork(containerID, nw); err != nil {
+				logger.Errorf("Error disconnecting container '%s' from network '%s': %v", containerName, nw, err)
+				continue
+			}
+			logger.Infof("Disconnected '%s' from network '%s', it is no longer managed by coredock", containerName, nw)
+			d.db.RemoveAttachment(containerID, nw)
+		}
+	}
 }
 
 func (d *DockerClient) connectMacvlanWithConflictHandling(c *docker.APIContainers, targetNetwork *docker.Network, ipv4, ipv6 string) error {
@@ -365,7 +684,6 @@ func (d *DockerClient) connectMacvlanWithConflictHandling(c *docker.APIContainer
 
 func (d *DockerClient) saveIp(c *docker.APIContainers, dnw *docker.Network) {
 	containerName := cleanContainerName(c.Names[0])
-	dbKey := fmt.Sprintf("%s-%s", containerName, dnw.Name)
 	inspected, err := d.client.InspectContainerWithOptions(docker.InspectContainerOptions{
 		ID: c.ID,
 	})
@@ -376,13 +694,8 @@ func (d *DockerClient) saveIp(c *docker.APIContainers, dnw *docker.Network) {
 	}
 
 	for name, ep := range inspected.NetworkSettings.Networks {
-		if name == dnw.Name {
-			if ep.IPAddress != "" {
-				d.db.Set(dbKey+":ipv4", ep.IPAddress)
-			}
-			if ep.GlobalIPv6Address != "" {
-				d.db.Set(dbKey+":ipv6", ep.GlobalIPv6Address)
-			}
+		if name == dnw.Name && (ep.IPAddress != "" || ep.GlobalIPv6Address != "") {
+			d.db.Reserve(containerName, dnw.Name, ep.IPAddress, ep.GlobalIPv6Address)
 		}
 	}
 }
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/thoas/go-funk"
+)
+
+// fakeDocker implements the parts of the Docker API coredock uses to list
+// containers and to disconnect them from networks.
+type fakeDocker struct {
+	mux          sync.Mutex
+	containers   []docker.APIContainers
+	disconnected []string
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/containers/json"):
+		json.NewEncoder(w).Encode(f.containers)
+	case strings.HasSuffix(r.URL.Path, "/disconnect"):
+		opts := docker.NetworkConnectionOptions{}
+		json.NewDecoder(r.Body).Decode(&opts)
+		nw := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/networks/"), "/disconnect")
+		f.disconnected = append(f.disconnected, opts.Container+"/"+nw)
+		for i, c := range f.containers {
+			if c.ID == opts.Container {
+				delete(f.containers[i].Networks.Networks, nw)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeDocker) disconnects() []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	list := append([]string{}, f.disconnected...)
+	sort.Strings(list)
+	return list
+}
+
+func (f *fakeDocker) setContainers(containers ...docker.APIContainers) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.containers = containers
+}
+
+func testContainer(id string, name string, labels map[string]string, networks map[string]string) docker.APIContainers {
+	c := docker.APIContainers{ID: id, Names: []string{"/" + name}, State: "running", Status: "Up 2 minutes", Labels: labels}
+	c.Networks.Networks = map[string]docker.ContainerNetwork{}
+	for nw, ip := range networks {
+		c.Networks.Networks[nw] = docker.ContainerNetwork{NetworkID: nw, IPAddress: ip}
+	}
+	return c
+}
+
+func testDockerClient(t *testing.T, fake *fakeDocker, config *Config) *DockerClient {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TTL == 0 {
+		config.TTL = 300
+	}
+	return &DockerClient{client: client, channel: make(chan *[]Service, 1), config: config, db: newTestDB(t), previousNames: []string{},
+		pinConflicts: map[string]string{}, lastKnown: map[string]*KnownService{}}
+}
+
+func TestReconcileAttachments(t *testing.T) {
+	fake := &fakeDocker{}
+	fake.setContainers(
+		testContainer("managed", "web", nil, map[string]string{"lan": "10.0.0.2"}),
+		testContainer("stale", "db", nil, map[string]string{"lan": "10.0.0.3", "old": "10.1.0.3"}),
+		testContainer("ignored", "cache", map[string]string{"coredock.ignore": ""}, map[string]string{"lan": "10.0.0.4"}),
+		testContainer("user", "proxy", nil, map[string]string{"old": "10.1.0.5"}),
+		testContainer("detached", "app", nil, map[string]string{}),
+	)
+	d := testDockerClient(t, fake, &Config{Networks: []string{"lan"}})
+	d.db.AddAttachment("managed", "lan")
+	d.db.AddAttachment("stale", "old")
+	d.db.AddAttachment("ignored", "lan")
+	d.db.AddAttachment("detached", "lan")
+	d.db.AddAttachment("removed", "lan")
+
+	d.reconcileAttachments()
+
+	// Only networks coredock attached and no longer manages are left, the
+	// network the user attached "proxy" to stays.
+	equalStrings(t, fake.disconnects(), "ignored/lan", "stale/old")
+	if attachments := d.db.Attachments(); len(attachments) != 1 || len(attachments["managed"]) != 1 {
+		t.Fatalf("expected only the managed attachment to be kept, got %v", attachments)
+	}
+}
+
+func TestParseKeepWhenStopped(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		invalid bool
+	}{
+		{"true", -1, false},
+		{"false", 0, false},
+		{"0", 0, false},
+		{"30", 30 * time.Second, false},
+		{" 2m ", 2 * time.Minute, false},
+		{"-5", 0, true},
+		{"-1s", 0, true},
+		{"forever", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseKeepWhenStopped(tt.value)
+		if (err != nil) != tt.invalid || got != tt.want {
+			t.Errorf("parseKeepWhenStopped(%q) = %s, %v, want %s, invalid %v", tt.value, got, err, tt.want, tt.invalid)
+		}
+	}
+}
+
+func TestStoppedGraceConfig(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"true", -1},
+		{"45s", 45 * time.Second},
+		{"nope", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("COREDOCK_STOPPED_GRACE", tt.value)
+		if got := NewConfig().StoppedGrace; got != tt.want {
+			t.Errorf("COREDOCK_STOPPED_GRACE=%q: got %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestUnhealthyContainersAreWithdrawn(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    string
+		labels    map[string]string
+		require   bool
+		published bool
+	}{
+		{"no healthcheck", "Up 2 minutes", nil, true, true},
+		{"healthy", "Up 2 minutes (healthy)", nil, true, true},
+		{"unhealthy", "Up 2 minutes (unhealthy)", nil, true, false},
+		{"starting", "Up 2 seconds (health: starting)", nil, true, false},
+		{"unhealthy, not required", "Up 2 minutes (unhealthy)", nil, false, true},
+		{"required by label", "Up 2 minutes (unhealthy)", map[string]string{"coredock.require_healthy": "true"}, false, false},
+		{"not required by label", "Up 2 minutes (unhealthy)", map[string]string{"coredock.require_healthy": "false"}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			web := testContainer("web-id", "web", tt.labels, map[string]string{"bridge": "172.17.0.2"})
+			web.Status = tt.status
+			fake := &fakeDocker{}
+			fake.setContainers(web, testContainer("db-id", "db", nil, map[string]string{"bridge": "172.17.0.3"}))
+			d := testDockerClient(t, fake, &Config{RequireHealthy: tt.require})
+
+			d.sendContainers()
+			services := <-d.channel
+			names := funk.Map(*services, func(s Service) string { return s.Name }).([]string)
+			if published := funk.ContainsString(names, "web"); published != tt.published {
+				t.Fatalf("expected published %v, got %v", tt.published, names)
+			}
+			if _, known := d.lastKnown["web-id"]; known != tt.published {
+				t.Fatalf("expected only published containers to be known, got %v", d.lastKnown)
+			}
+		})
+	}
+}
+
+func TestContainersTurningUnhealthyAreWithdrawn(t *testing.T) {
+	web := testContainer("web-id", "web", nil, map[string]string{"bridge": "172.17.0.2"})
+	web.Status = "Up 2 minutes (healthy)"
+	db := testContainer("db-id", "db", nil, map[string]string{"bridge": "172.17.0.3"})
+	fake := &fakeDocker{}
+	fake.setContainers(web, db)
+	d := testDockerClient(t, fake, &Config{RequireHealthy: true})
+
+	d.sendContainers()
+	if services := <-d.channel; len(*services) != 2 {
+		t.Fatalf("expected both containers, got %d", len(*services))
+	}
+	web.Status = "Up 3 minutes (unhealthy)"
+	fake.setContainers(web, db)
+	d.sendContainers()
+	if services := <-d.channel; len(*services) != 1 || (*services)[0].Name != "db" {
+		t.Fatalf("expected the unhealthy container to be withdrawn, got %v", *services)
+	}
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"net"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Interfaces created by Docker itself, their addresses aren't reachable from
+// other hosts.
+var dockerInterfacePrefixes = []string{"docker", "br-", "veth", "virbr"}
+
+func IsHostNetwork(c *docker.APIContainers) bool {
+	_, ok := c.Networks.Networks["host"]
+	return ok
+}
+
+// HostIPs returns the addresses of the Docker host, either COREDOCK_HOST_IPS
+// or the addresses of the host's interfaces. Discovery only sees the host's
+// interfaces if coredock itself runs in the host network, otherwise it would
+// return the addresses of coredock's own container.
+func HostIPs(conf *Config) []net.IP {
+	ips := []net.IP{}
+	if len(conf.HostIPs) > 0 {
+		for _, s := range conf.HostIPs {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				logger.Warnf("Ignoring invalid host IP '%s'", s)
+				continue
+			}
+			ips = append(ips, ip)
+		}
+		return ips
+	}
+	if !conf.HostNetwork {
+		return ips
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		logger.Errorf("Error listing host interfaces: %v", err)
+		return ips
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || isDockerInterface(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			if conf.AllowsIP(ipnet.IP) {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	return ips
+}
+
+func isDockerInterface(name string) bool {
+	for _, p := range dockerInterfacePrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHostService publishes the Docker host itself as <hostname>.<domain>.
+func NewHostService(hostname string, conf *Config) *Service {
+	c := &docker.APIContainers{ID: "host", Names: []string{"/" + hostname}}
+	c.Networks.Networks = map[string]docker.ContainerNetwork{"host": {}}
+	return NewService(c, "start", conf)
+}
@@ -0,0 +1,16 @@
+package internal
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHostIPsNeedHostNetwork(t *testing.T) {
+	if ips := HostIPs(&Config{HostNetwork: false}); len(ips) != 0 {
+		t.Fatalf("expected no discovered addresses outside the host network, got %v", ips)
+	}
+	ips := HostIPs(&Config{HostNetwork: false, HostIPs: []string{"10.0.0.5", "invalid"}})
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("expected the configured address, got %v", ips)
+	}
+}
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+type labelType int
+
+const (
+	labelFlag labelType = iota
+	labelBool
+	labelList
+	labelPort
+	labelRecord
+	labelIPv4
+	labelIPv6
+	labelIPOrder
+	labelKeep
+)
+
+// labelSpec describes a coredock.* label. Prefix labels take a suffix, i.e.
+// coredock.record.<id>. Synonyms are equivalent spellings, deprecated keys
+// still work but log a warning.
+type labelSpec struct {
+	Key        string
+	Prefix     bool
+	Type       labelType
+	Synonyms   []string
+	Deprecated []string
+}
+
+var labelSchema = []labelSpec{
+	{Key: "coredock.ignore", Type: labelFlag},
+	{Key: "coredock.domains", Type: labelList, Synonyms: []string{"coredock.domain"}},
+	{Key: "coredock.aliases", Type: labelList, Synonyms: []string{"coredock.alias"}},
+	{Key: "coredock.subdomains", Type: labelList, Synonyms: []string{"coredock.subdomain"}},
+	{Key: "coredock.wildcard", Type: labelBool},
+	{Key: "coredock.publish_ports", Type: labelBool},
+	{Key: "coredock.require_healthy", Type: labelBool},
+	{Key: "coredock.keep_when_stopped", Type: labelKeep},
+	{Key: "coredock.ip_order", Type: labelIPOrder},
+	{Key: "coredock.srv", Type: labelPort},
+	{Key: "coredock.srv.", Prefix: true, Type: labelPort, Deprecated: []string{"coredock.srv--"}},
+	{Key: "coredock.record.", Prefix: true, Type: labelRecord, Synonyms: []string{"coredock.records."}},
+	{Key: "coredock.ipv4.", Prefix: true, Type: labelIPv4},
+	{Key: "coredock.ipv6.", Prefix: true, Type: labelIPv6},
+}
+
+// lookupLabel returns the spec of a label and its canonical key.
+func lookupLabel(key string) (*labelSpec, string, bool) {
+	for i := range labelSchema {
+		spec := &labelSchema[i]
+		for _, k := range append([]string{spec.Key}, spec.Synonyms...) {
+			if key == k && !spec.Prefix {
+				return spec, spec.Key, false
+			}
+			if suffix, ok := strings.CutPrefix(key, k); ok && spec.Prefix && suffix != "" {
+				return spec, spec.Key + suffix, false
+			}
+		}
+		for _, k := range spec.Deprecated {
+			if key == k && !spec.Prefix {
+				return spec, spec.Key, true
+			}
+			if suffix, ok := strings.CutPrefix(key, k); ok && spec.Prefix && suffix != "" {
+				return spec, spec.Key + suffix, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+func validateLabel(spec *labelSpec, value string) error {
+	value = strings.TrimSpace(value)
+	switch spec.Type {
+	case labelBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+	case labelList:
+		for _, v := range splitList(value) {
+			if _, ok := dns.IsDomainName(v); !ok {
+				return fmt.Errorf("'%s' is not a valid name", v)
+			}
+		}
+	case labelPort:
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("expected a port number")
+		}
+	case labelRecord:
+		if _, _, err := parseRecords(value, "example.", 300); err != nil {
+			return err
+		}
+	case labelIPOrder:
+		for _, v := range splitList(value) {
+			if _, _, err := net.ParseCIDR(v); strings.Contains(v, "/") && err != nil {
+				return fmt.Errorf("'%s' is neither a network nor a CIDR", v)
+			}
+		}
+	case labelKeep:
+		if _, err := parseKeepWhenStopped(value); err != nil {
+			return fmt.Errorf("expected true, false or a duration")
+		}
+	case labelIPv4:
+		if ip := net.ParseIP(value); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("expected an IPv4 address")
+		}
+	case labelIPv6:
+		if ip := net.ParseIP(value); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("expected an IPv6 address")
+		}
+	}
+	return nil
+}
+
+// NormalizeLabels maps the coredock.* labels of a container to their
+// canonical keys. Unknown and malformed labels are dropped and reported.
+func NormalizeLabels(labels map[string]string) (map[string]string, []string) {
+	normalized := map[string]string{}
+	problems := []string{}
+
+	keys := []string{}
+	for key := range labels {
+		if strings.HasPrefix(key, "coredock.") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := labels[key]
+		spec, canonical, deprecated := lookupLabel(key)
+		if spec == nil {
+			problems = append(problems, fmt.Sprintf("unknown label '%s'", key))
+			continue
+		}
+		if err := validateLabel(spec, value); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid value '%s' for label '%s': %v", value, key, err))
+			continue
+		}
+		if deprecated {
+			problems = append(problems, fmt.Sprintf("label '%s' is deprecated, use '%s'", key, canonical))
+		}
+		if existing, ok := normalized[canonical]; ok {
+			if spec.Type != labelList {
+				problems = append(problems, fmt.Sprintf("label '%s' is set more than once, ignoring '%s'", canonical, key))
+				continue
+			}
+			value = existing + "," + value
+		}
+		normalized[canonical] = value
+	}
+	return normalized, problems
+}
+
+// warnLabels logs the label problems of a container once, not on every poll.
+func warnLabels(name string, problems []string) {
+	for _, p := range problems {
+		warnOnce("Container '%s': %s", name, p)
+	}
+}
+
+type composeFile struct {
+	Services map[string]struct {
+		ContainerName string    `yaml:"container_name"`
+		Labels        yaml.Node `yaml:"labels"`
+	} `yaml:"services"`
+}
+
+// composeLabels reads the labels of a service, which compose allows as a map
+// or as a list of key=value strings.
+func composeLabels(node yaml.Node) (map[string]string, error) {
+	labels := map[string]string{}
+	switch node.Kind {
+	case 0:
+	case yaml.MappingNode:
+		if err := node.Decode(&labels); err != nil {
+			return nil, err
+		}
+	case yaml.SequenceNode:
+		list := []string{}
+		if err := node.Decode(&list); err != nil {
+			return nil, err
+		}
+		for _, l := range list {
+			key, value, _ := strings.Cut(l, "=")
+			labels[key] = value
+		}
+	default:
+		return nil, fmt.Errorf("labels must be a map or a list")
+	}
+	return labels, nil
+}
+
+// ValidateComposeFile checks the coredock labels of all services in a
+// compose file and returns the problems found, prefixed by the name the
+// container is published under.
+func ValidateComposeFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	compose := composeFile{}
+	if err := yaml.Unmarshal(data, &compose); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	names := []string{}
+	for name := range compose.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := []string{}
+	for _, name := range names {
+		service := compose.Services[name]
+		display := name
+		if service.ContainerName != "" {
+			display = service.ContainerName
+		}
+		labels, err := composeLabels(service.Labels)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", display, err))
+			continue
+		}
+		_, labelProblems := NormalizeLabels(labels)
+		for _, p := range labelProblems {
+			problems = append(problems, fmt.Sprintf("%s: %s", display, p))
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		want     map[string]string
+		problems int
+	}{
+		{"other labels are ignored", map[string]string{"traefik.enable": "true"}, map[string]string{}, 0},
+		{"canonical keys", map[string]string{"coredock.aliases": "a,b", "coredock.wildcard": "true"}, map[string]string{"coredock.aliases": "a,b", "coredock.wildcard": "true"}, 0},
+		{"synonyms are merged", map[string]string{"coredock.alias": "a", "coredock.aliases": "b"}, map[string]string{"coredock.aliases": "a,b"}, 0},
+		{"prefix synonyms", map[string]string{"coredock.records.txt": "txt IN TXT \"x\""}, map[string]string{"coredock.record.txt": "txt IN TXT \"x\""}, 0},
+		{"deprecated keys work with a warning", map[string]string{"coredock.srv--api": "8080"}, map[string]string{"coredock.srv.api": "8080"}, 1},
+		{"unknown label", map[string]string{"coredock.alais": "a"}, map[string]string{}, 1},
+		{"prefix without suffix", map[string]string{"coredock.ipv4.": "10.0.0.2"}, map[string]string{}, 1},
+		{"invalid bool", map[string]string{"coredock.wildcard": "yes please"}, map[string]string{}, 1},
+		{"invalid name", map[string]string{"coredock.aliases": "a..b"}, map[string]string{}, 1},
+		{"invalid port", map[string]string{"coredock.srv": "70000"}, map[string]string{}, 1},
+		{"invalid record", map[string]string{"coredock.record.a": "a IN A nope"}, map[string]string{}, 1},
+		{"invalid IPv4", map[string]string{"coredock.ipv4.macvlan": "fd00::2"}, map[string]string{}, 1},
+		{"invalid IPv6", map[string]string{"coredock.ipv6.macvlan": "10.0.0.2"}, map[string]string{}, 1},
+		{"invalid ip order", map[string]string{"coredock.ip_order": "10.0.0.0/33"}, map[string]string{}, 1},
+		{"invalid keep", map[string]string{"coredock.keep_when_stopped": "forever"}, map[string]string{}, 1},
+		{"duplicate non-list labels", map[string]string{"coredock.record.a": "a IN A 10.0.0.1", "coredock.records.a": "a IN A 10.0.0.2"}, map[string]string{"coredock.record.a": "a IN A 10.0.0.1"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, problems := NormalizeLabels(tt.labels)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if len(problems) != tt.problems {
+				t.Errorf("expected %d problems, got %v", tt.problems, problems)
+			}
+		})
+	}
+}
+
+func TestValidateComposeFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		compose  string
+		problems int
+	}{
+		{"map labels", `
+services:
+  web:
+    labels:
+      coredock.aliases: www
+      coredock.wildcard: "true"
+`, 0},
+		{"list labels", `
+services:
+  web:
+    labels:
+      - coredock.aliases=www
+      - coredock.srv=8080
+`, 0},
+		{"problems of all services", `
+services:
+  web:
+    labels:
+      coredock.wildcard: maybe
+  db:
+    labels:
+      - coredock.alais=postgres
+      - coredock.srv--db=5432
+  cache: {}
+`, 3},
+		{"invalid labels", `
+services:
+  web:
+    labels: "coredock.aliases=www"
+`, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "compose.yml")
+			if err := os.WriteFile(path, []byte(tt.compose), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			problems, err := ValidateComposeFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != tt.problems {
+				t.Errorf("expected %d problems, got %v", tt.problems, problems)
+			}
+		})
+	}
+
+	// Problems are reported under the container's name.
+	path := filepath.Join(t.TempDir(), "compose.yml")
+	if err := os.WriteFile(path, []byte("services:\n  web:\n    container_name: nginx\n    labels:\n      coredock.wildcard: maybe\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := ValidateComposeFile(path); err != nil || len(problems) != 1 || !strings.HasPrefix(problems[0], "nginx: ") {
+		t.Errorf("expected a problem of nginx, got %v: %v", problems, err)
+	}
+
+	if _, err := ValidateComposeFile(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
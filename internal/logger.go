@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/lmittmann/tint"
@@ -35,6 +36,24 @@ func (l *Logger) Errorf(format string, args ...any) {
 
 var logger = InitLogger()
 
+var (
+	warned    = map[string]bool{}
+	warnedMux sync.Mutex
+)
+
+// warnOnce logs a warning only the first time, for problems that are found
+// again on every update.
+func warnOnce(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	warnedMux.Lock()
+	defer warnedMux.Unlock()
+	if warned[msg] {
+		return
+	}
+	warned[msg] = true
+	logger.Warn(msg)
+}
+
 func InitLogger() *Logger {
 	level := os.Getenv("COREDOCK_LOG_LEVEL")
 	l := slog.LevelInfo
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// sanitizeLabel turns s into a valid RFC 1123 label: lowercase letters,
+// digits and hyphens, not starting or ending with a hyphen, at most 63
+// characters long.
+func sanitizeLabel(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	label := strings.Trim(b.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+	return label
+}
+
+// sanitizeName sanitizes every label of a name like an alias or subdomain,
+// which may consist of several labels.
+func sanitizeName(s string) string {
+	labels := []string{}
+	for _, l := range strings.Split(s, ".") {
+		if l = sanitizeLabel(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func shortID(id string) string {
+	return id[:min(12, len(id))]
+}
+
+// sanitizeNames sanitizes a list of names and reports the ones that changed.
+func sanitizeNames(kind string, names []string) ([]string, []string) {
+	sanitized := []string{}
+	problems := []string{}
+	for _, n := range names {
+		s := sanitizeName(n)
+		if s == "" {
+			problems = append(problems, fmt.Sprintf("%s '%s' is not a valid DNS name, skipped", kind, n))
+			continue
+		}
+		if s != n {
+			problems = append(problems, fmt.Sprintf("%s '%s' is not a valid DNS name, published as '%s'", kind, n, s))
+		}
+		sanitized = append(sanitized, s)
+	}
+	return sanitized, problems
+}
+
+// dropConflictingCNAMEs enforces that a CNAME is the only record at its name.
+// Other data wins over a CNAME, so containers win over aliases. Of several
+// CNAMEs for a name, the first one wins, services are sorted by name and ID.
+func dropConflictingCNAMEs(zone string, records []dns.RR, warn bool) []dns.RR {
+	other := map[string]bool{}
+	for _, r := range records {
+		if r.Header().Rrtype != dns.TypeCNAME {
+			other[strings.ToLower(r.Header().Name)] = true
+		}
+	}
+
+	cnames := map[string]string{}
+	kept := []dns.RR{}
+	for _, r := range records {
+		c, ok := r.(*dns.CNAME)
+		if !ok {
+			kept = append(kept, r)
+			continue
+		}
+		name := strings.ToLower(c.Hdr.Name)
+		if other[name] {
+			if warn {
+				warnOnce("Zone %s: Alias %s -> %s collides with other records at that name, skipped", zone, c.Hdr.Name, c.Target)
+			}
+			continue
+		}
+		if target, ok := cnames[name]; ok {
+			if warn && !strings.EqualFold(target, c.Target) {
+				warnOnce("Zone %s: Alias %s -> %s collides with alias to %s, skipped", zone, c.Hdr.Name, c.Target, target)
+			}
+			continue
+		}
+		cnames[name] = c.Target
+		kept = append(kept, r)
+	}
+	return kept
+}
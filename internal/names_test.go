@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestSanitizeLabel(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"web", "web"},
+		{"Web_App", "web-app"},
+		{"my.app", "my-app"},
+		{"-web-", "web"},
+		{"__", ""},
+		{"ünïcode", "n-code"},
+		{strings.Repeat("a", 62) + "-b", strings.Repeat("a", 62)},
+		{strings.Repeat("a", 70), strings.Repeat("a", 63)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeLabel(tt.in); got != tt.want {
+			t.Errorf("sanitizeLabel(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"api.v1", "api.v1"},
+		{"API..V1.", "api.v1"},
+		{"my_api.v1", "my-api.v1"},
+		{"_._", ""},
+	}
+	for _, tt := range tests {
+		if got := sanitizeName(tt.in); got != tt.want {
+			t.Errorf("sanitizeName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	names, problems := sanitizeNames("alias", []string{"www", "My_App", "__"})
+	equalStrings(t, names, "www", "my-app")
+	equalStrings(t, problems,
+		"alias 'My_App' is not a valid DNS name, published as 'my-app'",
+		"alias '__' is not a valid DNS name, skipped",
+	)
+}
+
+func TestDropConflictingCNAMEs(t *testing.T) {
+	records := mustRRs(t,
+		"web.example. 300 IN A 10.0.0.2",
+		"web.example. 300 IN CNAME app.example.",
+		"www.example. 300 IN CNAME web.example.",
+		"www.example. 300 IN CNAME app.example.",
+		"app.example. 300 IN A 10.0.0.3",
+	)
+	equalRRs(t, dropConflictingCNAMEs("example", records, false), mustRRs(t,
+		"web.example. 300 IN A 10.0.0.2",
+		"www.example. 300 IN CNAME web.example.",
+		"app.example. 300 IN A 10.0.0.3",
+	))
+}
+
+func TestSRVWithoutValidName(t *testing.T) {
+	c := &docker.APIContainers{ID: "abc", Names: []string{"/web"}, Labels: map[string]string{
+		"coredock.srv._http._tcp.__":     "8080",
+		"coredock.srv._http._tcp.My_Api": "8081",
+	}}
+	s := NewService(c, "start", &Config{TTL: 300})
+	if len(s.SRVs) != 1 || s.SRVs[0].Name != "my-api" || s.SRVs[0].Prefix != "_http._tcp.my-api" {
+		t.Fatalf("expected only the sanitized SRV, got %+v", s.SRVs)
+	}
+}
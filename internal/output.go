@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/thoas/go-funk"
+)
+
+const outputHeader = "# Generated by coredock, do not edit.\n"
+
+// hostAddresses maps every forward name to its addresses, following CNAMEs
+// to their target. Names are returned in the order they were first seen.
+func hostAddresses(set *RecordSet) ([]string, map[string][]net.IP) {
+	names := []string{}
+	addrs := map[string][]net.IP{}
+	add := func(name string, ip net.IP) {
+		if _, ok := addrs[name]; !ok {
+			names = append(names, name)
+		}
+		addrs[name] = append(addrs[name], ip)
+	}
+
+	rrs := set.ForwardRecords()
+	for _, rr := range rrs {
+		if isWildcard(rr.Header().Name) {
+			continue
+		}
+		switch r := rr.(type) {
+		case *dns.A:
+			add(r.Hdr.Name, r.A)
+		case *dns.AAAA:
+			add(r.Hdr.Name, r.AAAA)
+		}
+	}
+	for _, rr := range rrs {
+		if r, ok := rr.(*dns.CNAME); ok {
+			for _, ip := range addrs[r.Target] {
+				add(r.Hdr.Name, ip)
+			}
+		}
+	}
+	return names, addrs
+}
+
+func isWildcard(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+// Wildcards can't be expressed in hosts files and are left out.
+func renderHosts(set *RecordSet) []byte {
+	var b strings.Builder
+	b.WriteString(outputHeader)
+
+	names, addrs := hostAddresses(set)
+	for _, name := range names {
+		for _, ip := range addrs[name] {
+			fmt.Fprintf(&b, "%s\t%s\n", ip, strings.TrimSuffix(name, "."))
+		}
+	}
+	return []byte(b.String())
+}
+
+func renderDnsmasq(set *RecordSet) []byte {
+	var b strings.Builder
+	b.WriteString(outputHeader)
+
+	// host-record= answers PTR queries as well, so only names with addresses
+	// get one. Aliases are cname= lines to them.
+	hasPTR := map[string]bool{}
+	for _, rr := range set.ForwardRecords() {
+		if isWildcard(rr.Header().Name) {
+			continue
+		}
+		var ip net.IP
+		switch r := rr.(type) {
+		case *dns.A:
+			ip = r.A
+		case *dns.AAAA:
+			ip = r.AAAA
+		default:
+			continue
+		}
+		fmt.Fprintf(&b, "host-record=%s,%s\n", strings.TrimSuffix(rr.Header().Name, "."), ip)
+		if reverse, err := dns.ReverseAddr(ip.String()); err == nil {
+			hasPTR[reverse] = true
+		}
+	}
+	_, addrs := hostAddresses(set)
+	for _, rr := range set.ForwardRecords() {
+		if r, ok := rr.(*dns.CNAME); ok && len(addrs[r.Target]) > 0 {
+			fmt.Fprintf(&b, "cname=%s,%s\n", strings.TrimSuffix(r.Hdr.Name, "."), strings.TrimSuffix(r.Target, "."))
+		}
+	}
+	// address= matches a name and all of its subdomains, so it is only used
+	// for wildcards.
+	for _, rr := range set.ForwardRecords() {
+		if !isWildcard(rr.Header().Name) {
+			continue
+		}
+		name := strings.TrimSuffix(rr.Header().Name[2:], ".")
+		switch r := rr.(type) {
+		case *dns.A:
+			fmt.Fprintf(&b, "address=/%s/%s\n", name, r.A)
+		case *dns.AAAA:
+			fmt.Fprintf(&b, "address=/%s/%s\n", name, r.AAAA)
+		}
+	}
+	for _, rr := range set.ForwardRecords() {
+		if r, ok := rr.(*dns.SRV); ok {
+			fmt.Fprintf(&b, "srv-host=%s,%s,%d,%d,%d\n", strings.TrimSuffix(r.Hdr.Name, "."), strings.TrimSuffix(r.Target, "."), r.Port, r.Priority, r.Weight)
+		}
+	}
+	for _, rr := range set.ReverseRecords() {
+		if r, ok := rr.(*dns.PTR); ok && !hasPTR[r.Hdr.Name] {
+			fmt.Fprintf(&b, "ptr-record=%s,%s\n", strings.TrimSuffix(r.Hdr.Name, "."), strings.TrimSuffix(r.Ptr, "."))
+		}
+	}
+	return []byte(b.String())
+}
+
+// renderPiholeHosts renders A and AAAA records in Pi-hole's custom.list
+// format. CNAMEs go to a separate file, see renderPiholeCNAMEs.
+func renderPiholeHosts(set *RecordSet) []byte {
+	var b strings.Builder
+
+	for _, rr := range set.ForwardRecords() {
+		name := strings.TrimSuffix(rr.Header().Name, ".")
+		if isWildcard(name) {
+			continue
+		}
+		switch r := rr.(type) {
+		case *dns.A:
+			fmt.Fprintf(&b, "%s %s\n", r.A, name)
+		case *dns.AAAA:
+			fmt.Fprintf(&b, "%s %s\n", r.AAAA, name)
+		}
+	}
+	return []byte(b.String())
+}
+
+func renderPiholeCNAMEs(set *RecordSet) []byte {
+	var b strings.Builder
+	b.WriteString(outputHeader)
+
+	for _, rr := range set.ForwardRecords() {
+		if r, ok := rr.(*dns.CNAME); ok {
+			fmt.Fprintf(&b, "cname=%s,%s\n", strings.TrimSuffix(r.Hdr.Name, "."), strings.TrimSuffix(r.Target, "."))
+		}
+	}
+	return []byte(b.String())
+}
+
+func renderUnbound(set *RecordSet, zoneType string) []byte {
+	var b strings.Builder
+	b.WriteString(outputHeader)
+	b.WriteString("server:\n")
+
+	for _, name := range set.ZoneNames() {
+		if strings.HasSuffix(name, ".arpa") {
+			continue
+		}
+		fmt.Fprintf(&b, "    local-zone: \"%s.\" %s\n", name, zoneType)
+	}
+
+	// Unbound has no wildcard local-data, a redirect zone answers all
+	// subdomains with the records of its apex instead.
+	rrs := append(set.ForwardRecords(), set.ReverseRecords()...)
+	redirects := []string{}
+	for _, rr := range rrs {
+		if name := rr.Header().Name; isWildcard(name) && !funk.ContainsString(redirects, name[2:]) {
+			redirects = append(redirects, name[2:])
+			fmt.Fprintf(&b, "    local-zone: \"%s\" redirect\n", name[2:])
+		}
+	}
+	for _, rr := range rrs {
+		if isWildcard(rr.Header().Name) {
+			continue
+		}
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA, *dns.CNAME, *dns.SRV, *dns.PTR:
+			fmt.Fprintf(&b, "    local-data: \"%s\"\n", unboundRR(rr))
+		}
+	}
+	return []byte(b.String())
+}
+
+func unboundRR(rr dns.RR) string {
+	return strings.ReplaceAll(strings.Join(strings.Fields(rr.String()), " "), "\"", "\\\"")
+}
+
+type jsonZone struct {
+	Serial  uint32   `json:"serial"`
+	Records []string `json:"records"`
+}
+
+type jsonSnapshot struct {
+	Services []Service           `json:"services"`
+	Zones    map[string]jsonZone `json:"zones"`
+}
+
+func renderJSON(set *RecordSet) []byte {
+	snapshot := jsonSnapshot{Services: set.Services, Zones: map[string]jsonZone{}}
+	for name, zone := range set.Zones {
+		records := []string{}
+		for _, r := range zone.Records {
+			records = append(records, r.String())
+		}
+		snapshot.Zones[name] = jsonZone{Serial: zone.SOA.(*dns.SOA).Serial, Records: records}
+	}
+	data, _ := json.MarshalIndent(snapshot, "", "  ")
+	return append(data, '\n')
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func testRecordSet(t *testing.T) *RecordSet {
+	t.Helper()
+	forward := mustRRs(t,
+		"web.example. 300 IN A 10.0.0.2",
+		"web.example. 300 IN AAAA fd00::2",
+		"*.web.example. 300 IN A 10.0.0.2",
+		"www.example. 300 IN CNAME web.example.",
+		"_http._tcp.web.example. 300 IN SRV 10 5 8080 web.example.",
+	)
+	reverse := mustRRs(t, "2.0.0.10.in-addr.arpa. 300 IN PTR web.example.")
+	return &RecordSet{
+		Services: []Service{{ID: "abc", Name: "web"}},
+		Zones: map[string]*Zone{
+			"example":             {Name: "example", SOA: testSOA(t, 1), Records: forward},
+			"0.0.10.in-addr.arpa": {Name: "0.0.10.in-addr.arpa", SOA: testSOA(t, 1), Records: reverse},
+			"0.10.in-addr.arpa":   {Name: "0.10.in-addr.arpa", SOA: testSOA(t, 1), Records: reverse},
+		},
+	}
+}
+
+func equalLines(t *testing.T, got []byte, want ...string) {
+	t.Helper()
+	g := strings.Split(strings.TrimSuffix(string(got), "\n"), "\n")
+	if len(g) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(g), len(want), got)
+	}
+	for i := range g {
+		if g[i] != want[i] {
+			t.Fatalf("line %d differs:\n got: %s\nwant: %s", i+1, g[i], want[i])
+		}
+	}
+}
+
+func TestRenderHosts(t *testing.T) {
+	equalLines(t, renderHosts(testRecordSet(t)),
+		"# Generated by coredock, do not edit.",
+		"10.0.0.2\tweb.example",
+		"fd00::2\tweb.example",
+		"10.0.0.2\twww.example",
+		"fd00::2\twww.example",
+	)
+}
+
+func TestRenderDnsmasq(t *testing.T) {
+	set := testRecordSet(t)
+	// PTRs of host-record= addresses are left out, other PTRs are kept.
+	reverse := set.Zones["0.0.10.in-addr.arpa"]
+	reverse.Records = append(reverse.Records, mustRR(t, "9.0.0.10.in-addr.arpa. 300 IN PTR printer.example."))
+	equalLines(t, renderDnsmasq(set),
+		"# Generated by coredock, do not edit.",
+		"host-record=web.example,10.0.0.2",
+		"host-record=web.example,fd00::2",
+		"cname=www.example,web.example",
+		"address=/web.example/10.0.0.2",
+		"srv-host=_http._tcp.web.example,web.example,8080,10,5",
+		"ptr-record=9.0.0.10.in-addr.arpa,printer.example",
+	)
+}
+
+func TestRenderUnbound(t *testing.T) {
+	equalLines(t, renderUnbound(testRecordSet(t), "transparent"),
+		"# Generated by coredock, do not edit.",
+		"server:",
+		`    local-zone: "example." transparent`,
+		`    local-zone: "web.example." redirect`,
+		`    local-data: "web.example. 300 IN A 10.0.0.2"`,
+		`    local-data: "web.example. 300 IN AAAA fd00::2"`,
+		`    local-data: "www.example. 300 IN CNAME web.example."`,
+		`    local-data: "_http._tcp.web.example. 300 IN SRV 10 5 8080 web.example."`,
+		`    local-data: "2.0.0.10.in-addr.arpa. 300 IN PTR web.example."`,
+	)
+}
+
+func TestRenderJSON(t *testing.T) {
+	snapshot := jsonSnapshot{}
+	if err := json.Unmarshal(renderJSON(testRecordSet(t)), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Services) != 1 || snapshot.Services[0].Name != "web" {
+		t.Fatalf("unexpected services %+v", snapshot.Services)
+	}
+	zone, ok := snapshot.Zones["example"]
+	if !ok || zone.Serial != 1 || len(zone.Records) != 5 {
+		t.Fatalf("unexpected zone %+v", zone)
+	}
+}
+
+func TestZoneFileSinkRewritesDeletedFiles(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewZoneFileSink(&Config{ZoneDir: dir, TTL: 300})
+	set := testRecordSet(t)
+	path := filepath.Join(dir, "db.example")
+
+	if err := sink.Write(set); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(set); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("zone file was not written again: %v", err)
+	}
+
+	zp := dns.NewZoneParser(strings.NewReader(string(data)), "", path)
+	count := 0
+	for _, ok := zp.Next(); ok; _, ok = zp.Next() {
+		count++
+	}
+	if err := zp.Err(); err != nil || count != 6 {
+		t.Fatalf("expected SOA and 5 records, got %d: %v", count, err)
+	}
+}
+
+func TestRenderPihole(t *testing.T) {
+	set := testRecordSet(t)
+	equalLines(t, renderPiholeHosts(set),
+		"10.0.0.2 web.example",
+		"fd00::2 web.example",
+	)
+	equalLines(t, renderPiholeCNAMEs(set),
+		"# Generated by coredock, do not edit.",
+		"cname=www.example,web.example",
+	)
+}
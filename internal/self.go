@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+	"github.com/thoas/go-funk"
+)
+
+var (
+	// i.e. 0::/system.slice/docker-<id>.scope or 12:cpu:/docker/<id>
+	cgroupIDPattern = regexp.MustCompile(`(?:docker|containerd|cri-containerd|libpod)[-/]([0-9a-f]{64})`)
+	// i.e. /var/lib/docker/containers/<id>/hostname
+	mountIDPattern  = regexp.MustCompile(`/containers/([0-9a-f]{64})/`)
+	hostnamePattern = regexp.MustCompile(`^[0-9a-f]{12}$`)
+)
+
+// detectSelf returns the ID, or a prefix of it, of the container coredock runs
+// in. COREDOCK_SELF wins, then /proc/self/cgroup, /proc/self/mountinfo and
+// the hostname, which Docker sets to the short container ID by default.
+func detectSelf(conf *Config) string {
+	if conf.Self != "" {
+		return conf.Self
+	}
+	if data, err := os.ReadFile("/proc/self/cgroup"); err == nil {
+		if m := cgroupIDPattern.FindSubmatch(data); m != nil {
+			return string(m[1])
+		}
+	}
+	if data, err := os.ReadFile("/proc/self/mountinfo"); err == nil {
+		if m := mountIDPattern.FindSubmatch(data); m != nil {
+			return string(m[1])
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil && hostnamePattern.MatchString(hostname) {
+		return hostname
+	}
+	return ""
+}
+
+// inHostNetwork reports whether coredock shares the host's network namespace,
+// which is needed to discover the host's addresses from its interfaces.
+// Outside of a container coredock runs on the host itself.
+func inHostNetwork(client *docker.Client, self string) bool {
+	if self == "" {
+		_, err := os.Stat("/.dockerenv")
+		return err != nil
+	}
+	inspected, err := client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: self})
+	if err != nil {
+		logger.Errorf("Error inspecting coredock's own container: %v", err)
+		return false
+	}
+	return inspected.HostConfig != nil && inspected.HostConfig.NetworkMode == "host"
+}
+
+// isSelf matches a container against the detected ID prefix, or the
+// container name from COREDOCK_SELF.
+func isSelf(self string, c *docker.APIContainers) bool {
+	if self == "" {
+		return false
+	}
+	if len(self) >= 12 && strings.HasPrefix(c.ID, self) {
+		return true
+	}
+	return funk.ContainsString(funk.Map(c.Names, cleanContainerName).([]string), self)
+}
+
+// NewSelfServices publishes coredock's own container under the nameservers of
+// COREDOCK_NS_NAMES that are relative to the zones, or as ns.<domain>, so the
+// NS records and the SOA point at it.
+func NewSelfServices(c *docker.APIContainers, conf *Config) []Service {
+	names := []string{}
+	for _, n := range conf.NSNames {
+		if !dns.IsFqdn(n) {
+			names = append(names, strings.ToLower(n))
+		}
+	}
+	if len(conf.NSNames) == 0 {
+		names = append(names, defaultNSName)
+	}
+	if len(names) == 0 {
+		warnOnce("COREDOCK_PUBLISH_SELF: None of COREDOCK_NS_NAMES is relative to the zones, coredock is not published")
+	}
+
+	services := []Service{}
+	for _, name := range names {
+		self := *c
+		self.Names = []string{"/" + defaultNSName}
+		self.Labels = map[string]string{}
+		s := NewService(&self, "start", conf)
+		// Relative names may have several labels, i.e. ns1.dns.
+		s.Name = name
+		s.Self = true
+		services = append(services, *s)
+	}
+	return services
+}
@@ -1,14 +1,17 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	docker "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
 	"github.com/thoas/go-funk"
 )
 
@@ -19,15 +22,97 @@ type SRV struct {
 }
 
 type Service struct {
-	ID      string
-	Name    string
-	IPs     []net.IP
-	Aliases []string
-	Domains []string
-	Hosts   []string
-	Action  string
-	Ignore  bool
-	SRVs    []SRV
+	ID           string
+	Name         string
+	IPs          []net.IP
+	Aliases      []string
+	Domains      []string
+	Hosts        []string
+	Action       string
+	Ignore       bool
+	SRVs         []SRV
+	Wildcard     bool
+	Subdomains   []string
+	Records      []string
+	PublishPorts bool
+	PortMap      map[string]int
+	NetworkIPs   map[string][]net.IP
+	IPOrder      []string
+
+	// DomainRecords holds the parsed Records for each domain.
+	DomainRecords map[string][]dns.RR `json:"-"`
+	// Self is coredock's own container, published as the nameserver.
+	Self bool
+}
+
+type PinnedIP struct {
+	Network string
+	IPv4    string
+	IPv6    string
+}
+
+func (p *PinnedIP) String() string {
+	return strings.Join(funk.FilterString([]string{p.IPv4, p.IPv6}, func(ip string) bool { return ip != "" }), ",")
+}
+
+func (p *PinnedIP) Matches(ipv4 string, ipv6 string) bool {
+	return (p.IPv4 == "" || p.IPv4 == ipv4) && (p.IPv6 == "" || p.IPv6 == ipv6)
+}
+
+func (p *PinnedIP) Validate(nw *docker.Network) error {
+	for _, ip := range []string{p.IPv4, p.IPv6} {
+		if ip == "" {
+			continue
+		}
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return fmt.Errorf("'%s' is not a valid IP address", ip)
+		}
+		if len(nw.IPAM.Config) == 0 {
+			continue
+		}
+		inSubnet := false
+		for _, cfg := range nw.IPAM.Config {
+			_, subnet, err := net.ParseCIDR(cfg.Subnet)
+			if err == nil && subnet.Contains(parsed) {
+				inSubnet = true
+				break
+			}
+		}
+		if !inSubnet {
+			return fmt.Errorf("'%s' is outside of the network's subnets", ip)
+		}
+	}
+	return nil
+}
+
+// ParsePinnedIPs reads coredock.ipv4.<network> and coredock.ipv6.<network> labels.
+func ParsePinnedIPs(labels map[string]string) map[string]*PinnedIP {
+	labels, _ = NormalizeLabels(labels)
+	pins := map[string]*PinnedIP{}
+	for key, value := range labels {
+		family := ""
+		network := ""
+		if n, ok := strings.CutPrefix(key, "coredock.ipv4."); ok {
+			family, network = "ipv4", n
+		} else if n, ok := strings.CutPrefix(key, "coredock.ipv6."); ok {
+			family, network = "ipv6", n
+		} else {
+			continue
+		}
+		if network == "" {
+			continue
+		}
+		if _, ok := pins[network]; !ok {
+			pins[network] = &PinnedIP{Network: network}
+		}
+		if family == "ipv4" {
+			pins[network].IPv4 = strings.TrimSpace(value)
+		} else {
+			pins[network].IPv6 = strings.TrimSpace(value)
+		}
+	}
+	return pins
 }
 
 func (s Service) String() string {
@@ -37,39 +122,30 @@ func (s Service) String() string {
 
 func NewService(c *docker.APIContainers, action string, conf *Config) *Service {
 	ips := []net.IP{}
-	for _, netw := range c.Networks.Networks {
+	networkIPs := map[string][]net.IP{}
+	for name, netw := range c.Networks.Networks {
 		ip := net.ParseIP(netw.IPAddress)
 		ipv6 := net.ParseIP(netw.GlobalIPv6Address)
 		if ip == nil && ipv6 == nil {
 			continue
 		}
-
-		foundPrefix := false
-		ignorePrefix := false
-
-		for _, p := range conf.IPPrefixes {
-			if strings.HasPrefix(ip.String(), p) || ipv6 != nil && strings.HasPrefix(ipv6.String(), p) {
-				foundPrefix = true
-				break
-			}
-		}
-
-		for _, p := range conf.IPPrefixesIgnore {
-			if strings.HasPrefix(ip.String(), p) || ipv6 != nil && strings.HasPrefix(ipv6.String(), p) {
-
-				ignorePrefix = true
-				break
-			}
-		}
-		if !foundPrefix && len(conf.IPPrefixes) > 0 || ignorePrefix && len(conf.IPPrefixesIgnore) > 0 {
+		if !conf.AllowsIP(ip, ipv6) {
 			continue
 		}
-
-		ips = append(ips, ip)
+		if ip != nil {
+			ips = append(ips, ip)
+			networkIPs[name] = append(networkIPs[name], ip)
+		}
 		if ipv6 != nil {
 			ips = append(ips, ipv6)
+			networkIPs[name] = append(networkIPs[name], ipv6)
 		}
 	}
+	if IsHostNetwork(c) {
+		hostIPs := HostIPs(conf)
+		ips = append(ips, hostIPs...)
+		networkIPs["host"] = hostIPs
+	}
 
 	s := &Service{
 		ID:      c.ID,
@@ -80,25 +156,190 @@ func NewService(c *docker.APIContainers, action string, conf *Config) *Service {
 		SRVs:    []SRV{},
 		Name:    cleanContainerName(c.Names[0]),
 	}
+	s.NetworkIPs = networkIPs
+	if name := sanitizeLabel(s.Name); name != s.Name {
+		if name == "" {
+			name = shortID(c.ID)
+		}
+		warnLabels(s.Name, []string{fmt.Sprintf("name is not a valid DNS label, published as '%s'", name)})
+		s.Name = name
+	}
 	s = s.ParseLabels(c)
+	if s.PublishPorts {
+		s.publishPorts(c, conf)
+	}
+	// The Corefile is written once on startup, so loadbalance can't be
+	// turned off for a single container.
+	if len(s.IPOrder) > 0 && conf.LoadBalance {
+		warnLabels(s.Name, []string{"coredock.ip_order has no effect while COREDOCK_LOADBALANCE is on"})
+	}
+	if len(s.IPOrder) == 0 {
+		s.IPOrder = conf.IPOrder
+	}
+	s.orderIPs()
 
-	s.Aliases = funk.UniqString(s.Aliases)
+	aliases, aliasProblems := sanitizeNames("alias", s.Aliases)
+	subdomains, subdomainProblems := sanitizeNames("subdomain", s.Subdomains)
+	warnLabels(s.Name, append(aliasProblems, subdomainProblems...))
+	s.Aliases = funk.UniqString(funk.FilterString(aliases, func(a string) bool { return a != s.Name }))
+	s.Subdomains = funk.UniqString(subdomains)
+	srvs := []SRV{}
+	for _, srv := range s.SRVs {
+		name := sanitizeName(srv.Name)
+		if name == "" {
+			warnLabels(s.Name, []string{fmt.Sprintf("SRV record '%s' has no valid DNS name, skipped", srv.Prefix)})
+			continue
+		}
+		if name != srv.Name {
+			srv.Prefix = strings.TrimSuffix(srv.Prefix, srv.Name) + name
+			srv.Name = name
+		}
+		srvs = append(srvs, srv)
+	}
+	s.SRVs = srvs
+	s.Records = funk.UniqString(s.Records)
+	sort.Strings(s.Records)
 
+	networks := funk.Keys(networkIPs).([]string)
+	sort.Strings(networks)
+	for _, nw := range networks {
+		s.Domains = append(s.Domains, conf.NetworkDomains[nw]...)
+	}
 	s.Domains = append(s.Domains, conf.Domains...)
 	s.Domains = funk.UniqString(s.Domains)
 
 	for _, d := range s.Domains {
 		s.Hosts = append(s.Hosts, fmt.Sprintf("%s.%s", s.Name, d))
+		for _, sub := range s.Subdomains {
+			s.Hosts = append(s.Hosts, fmt.Sprintf("%s.%s.%s", sub, s.Name, d))
+		}
 		for _, a := range s.Aliases {
 			s.Hosts = append(s.Hosts, fmt.Sprintf("%s.%s", a, d))
 		}
 	}
 
 	s.Hosts = funk.UniqString(s.Hosts)
+	s.ParseRecords(conf.TTL)
 
 	return s
 }
 
+// ParseRecords parses the coredock.record.* labels once for every domain of
+// the service. Names are relative to the domain, so each record is published
+// once per domain. Invalid records are skipped, with a warning only the first
+// time, as known services are parsed again on every poll.
+func (s *Service) ParseRecords(ttl int) {
+	s.DomainRecords = map[string][]dns.RR{}
+	problems := []string{}
+	for _, domain := range s.Domains {
+		origin := dns.Fqdn(domain)
+		rrs := []dns.RR{}
+		for _, raw := range s.Records {
+			parsed, recordProblems, err := parseRecords(raw, origin, ttl)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("Ignoring invalid record '%s': %v", raw, err))
+				continue
+			}
+			for _, p := range recordProblems {
+				problems = append(problems, fmt.Sprintf("Ignoring record '%s': %s", raw, p))
+			}
+			rrs = append(rrs, parsed...)
+		}
+		s.DomainRecords[domain] = rrs
+	}
+	warnLabels(s.Name, problems)
+}
+
+// publishPorts replaces the container's IPs with the host addresses its
+// published ports are bound to. Containers without published ports keep
+// their IPs, as do containers whose ports are bound to all addresses if no
+// host address is known.
+func (s *Service) publishPorts(c *docker.APIContainers, conf *Config) {
+	ips := []net.IP{}
+	portMap := map[string]int{}
+	for _, p := range c.Ports {
+		if p.PublicPort == 0 {
+			continue
+		}
+		ip := net.ParseIP(p.IP)
+		if ip != nil && ip.IsLoopback() {
+			continue
+		}
+		if ip == nil || ip.IsUnspecified() {
+			ips = append(ips, HostIPs(conf)...)
+		} else {
+			ips = append(ips, ip)
+		}
+		key := fmt.Sprintf("%d/%s", p.PrivatePort, p.Type)
+		if _, ok := portMap[key]; !ok {
+			portMap[key] = int(p.PublicPort)
+		}
+	}
+	if len(portMap) == 0 {
+		return
+	}
+	if len(ips) == 0 {
+		warnLabels(s.Name, []string{"ports are published on all addresses, but no host address is known, set COREDOCK_HOST_IPS. Publishing the container's IPs"})
+		return
+	}
+
+	s.IPs = []net.IP{}
+	for _, ip := range ips {
+		if !funk.Contains(s.IPs, func(i net.IP) bool { return i.Equal(ip) }) {
+			s.IPs = append(s.IPs, ip)
+		}
+	}
+	s.PortMap = portMap
+	// The container's networks are kept for COREDOCK_NETWORK_DOMAINS, views
+	// and coredock.ip_order.
+	networkIPs := map[string][]net.IP{"host": s.IPs}
+	for nw, nwIPs := range s.NetworkIPs {
+		if nw != "host" {
+			networkIPs[nw] = nwIPs
+		}
+	}
+	s.NetworkIPs = networkIPs
+}
+
+// orderIPs sorts the IPs by the first network or CIDR of IPOrder they belong
+// to. Without a match, IPs are sorted by address after the matching ones.
+func (s *Service) orderIPs() {
+	rank := func(ip net.IP) int {
+		for i, entry := range s.IPOrder {
+			if _, cidr, err := net.ParseCIDR(entry); err == nil {
+				if cidr.Contains(ip) {
+					return i
+				}
+				continue
+			}
+			if funk.Contains(s.NetworkIPs[entry], func(i net.IP) bool { return i.Equal(ip) }) {
+				return i
+			}
+		}
+		return len(s.IPOrder)
+	}
+	sort.SliceStable(s.IPs, func(i, j int) bool {
+		ri, rj := rank(s.IPs[i]), rank(s.IPs[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return bytes.Compare(s.IPs[i], s.IPs[j]) < 0
+	})
+}
+
+// PublicPort returns the port a SRV record should point at, which is the
+// published port if the container is published at the host.
+func (s *Service) PublicPort(srv SRV) int {
+	proto := "tcp"
+	if strings.Contains(srv.Prefix, "._udp.") {
+		proto = "udp"
+	}
+	if port, ok := s.PortMap[fmt.Sprintf("%d/%s", srv.Port, proto)]; ok {
+		return port
+	}
+	return srv.Port
+}
+
 func (s *Service) GetHosts(domain string) []string {
 	return funk.FilterString(s.Hosts, func(h string) bool {
 		return strings.HasSuffix(h, domain)
@@ -106,44 +347,60 @@ func (s *Service) GetHosts(domain string) []string {
 }
 
 func (s *Service) ParseLabels(c *docker.APIContainers) *Service {
-	for key, value := range c.Labels {
-		if !strings.HasPrefix(key, "coredock") {
-			continue
-		}
-		// logger.Debugf("%s: %v", key, value)
+	labels, problems := NormalizeLabels(c.Labels)
+	warnLabels(s.Name, problems)
+
+	// Sorted, so coredock.aliases is known when coredock.srv is handled.
+	keys := funk.Keys(labels).([]string)
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := strings.TrimSpace(labels[key])
 		if key == "coredock.ignore" {
 			s.Ignore = true
 		}
 		if key == "coredock.domains" {
-			ds := funk.Map(strings.Split(value, ","), func(d string) string {
-				return strings.TrimSpace(d)
-			}).([]string)
-			s.Domains = append(s.Domains, ds...)
+			s.Domains = append(s.Domains, splitList(value)...)
+		}
+
+		if key == "coredock.wildcard" {
+			s.Wildcard, _ = strconv.ParseBool(value)
+		}
+
+		if key == "coredock.subdomains" {
+			s.Subdomains = append(s.Subdomains, splitList(value)...)
+		}
+
+		if strings.HasPrefix(key, "coredock.record.") && value != "" {
+			s.Records = append(s.Records, value)
+		}
+
+		if key == "coredock.publish_ports" {
+			s.PublishPorts, _ = strconv.ParseBool(value)
+		}
+
+		if key == "coredock.ip_order" {
+			s.IPOrder = splitList(value)
 		}
 
 		if key == "coredock.aliases" {
-			as := funk.Map(strings.Split(value, ","), func(a string) string {
-				return strings.TrimSpace(a)
-			}).([]string)
-			s.Aliases = append(s.Aliases, as...)
+			s.Aliases = append(s.Aliases, splitList(value)...)
 		}
 
-		if strings.HasPrefix(key, "coredock.srv") {
-			split := strings.Split(key, "--")
+		if key == "coredock.srv" || strings.HasPrefix(key, "coredock.srv.") {
 			port, err := strconv.Atoi(value)
 			if err != nil {
 				continue
 			}
 			srv := SRV{Port: port}
-			if len(split) == 1 {
+			name, named := strings.CutPrefix(key, "coredock.srv.")
+			if !named {
 				srv.Prefix = fmt.Sprintf("_http._tcp.%s", s.Name)
 				srv.Name = s.Name
 				for _, a := range s.Aliases {
 					s.SRVs = append(s.SRVs, SRV{Name: a, Prefix: fmt.Sprintf("_http._tcp.%s", a), Port: port})
 				}
-			}
-			if len(split) == 2 {
-				name := split[1]
+			} else {
 				pattern := "_([a-zA-Z0-9]+)._([a-zA-Z0-9]+).(.*)"
 				re := regexp.MustCompile(pattern)
 				matches := re.FindStringSubmatch(name)
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"net"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestServiceParseRecords(t *testing.T) {
+	s := &Service{Name: "web", Domains: []string{"example", "lan"}, Records: []string{
+		"txt IN TXT \"hello\"",
+		"@ IN SOA ns.example. hostmaster.example. 1 2 3 4 5",
+		"other.test. IN A 10.0.0.1",
+		"broken IN A not-an-ip",
+	}}
+	s.ParseRecords(300)
+
+	equalRRs(t, s.DomainRecords["example"], mustRRs(t, "txt.example. 300 IN TXT \"hello\""))
+	equalRRs(t, s.DomainRecords["lan"], mustRRs(t, "txt.lan. 300 IN TXT \"hello\""))
+
+	// Records are copied, so zones can't change the parsed records.
+	rrs := NewDNSProvider(&Config{TTL: 300}).GetRawRecords(s, "example")
+	rrs[0].Header().Ttl = 60
+	if s.DomainRecords["example"][0].Header().Ttl != 300 {
+		t.Fatalf("expected the parsed record to stay unchanged")
+	}
+}
+
+func TestWildcardAndSubdomains(t *testing.T) {
+	config := &Config{TTL: 300, Domains: []string{"example"}}
+	c := &docker.APIContainers{ID: "web-id", Names: []string{"/web"}, Labels: map[string]string{
+		"coredock.wildcard":   "true",
+		"coredock.subdomains": "api, Admin.v2 ,_",
+	}}
+	c.Networks.Networks = map[string]docker.ContainerNetwork{"bridge": {IPAddress: "172.17.0.2", GlobalIPv6Address: "fd00::2"}}
+	s := NewService(c, "start", config)
+	equalStrings(t, s.Subdomains, "api", "admin.v2")
+
+	set := NewZoneHandler(config, newTestDB(t), nil).buildRecordSet("", []Service{*s}, NewDNSProvider(config))
+	equalRRs(t, set.Zones["example"].Records, mustRRs(t,
+		"web.example. 300 IN A 172.17.0.2",
+		"api.web.example. 300 IN A 172.17.0.2",
+		"admin.v2.web.example. 300 IN A 172.17.0.2",
+		"*.web.example. 300 IN A 172.17.0.2",
+		"web.example. 300 IN AAAA fd00::2",
+		"api.web.example. 300 IN AAAA fd00::2",
+		"admin.v2.web.example. 300 IN AAAA fd00::2",
+		"*.web.example. 300 IN AAAA fd00::2",
+	))
+	// Only the container's own name gets a PTR.
+	equalRRs(t, set.Zones["172.in-addr.arpa"].Records, mustRRs(t, "2.0.17.172.in-addr.arpa. 300 IN PTR web.example."))
+}
+
+func TestPublishPorts(t *testing.T) {
+	c := &docker.APIContainers{ID: "web-id", Names: []string{"/web"}, Labels: map[string]string{"coredock.publish_ports": "true"},
+		Ports: []docker.APIPort{{PrivatePort: 80, PublicPort: 8080, Type: "tcp", IP: "0.0.0.0"}}}
+	c.Networks.Networks = map[string]docker.ContainerNetwork{"bridge": {IPAddress: "172.17.0.2"}}
+
+	// Without a host address, the container's IPs are kept.
+	s := NewService(c, "start", &Config{})
+	if len(s.IPs) != 1 || !s.IPs[0].Equal(net.ParseIP("172.17.0.2")) || s.PortMap != nil {
+		t.Fatalf("expected the container IP, got %v and ports %v", s.IPs, s.PortMap)
+	}
+
+	s = NewService(c, "start", &Config{HostIPs: []string{"10.0.0.5"}})
+	if len(s.IPs) != 1 || !s.IPs[0].Equal(net.ParseIP("10.0.0.5")) || s.PortMap["80/tcp"] != 8080 {
+		t.Fatalf("expected the host IP, got %v and ports %v", s.IPs, s.PortMap)
+	}
+	if len(s.NetworkIPs["host"]) != 1 || len(s.NetworkIPs["bridge"]) != 1 {
+		t.Fatalf("expected the host and the container's networks, got %v", s.NetworkIPs)
+	}
+}
+
+func TestOrderIPs(t *testing.T) {
+	networkIPs := map[string][]net.IP{
+		"bridge":  {net.ParseIP("172.17.0.2")},
+		"macvlan": {net.ParseIP("192.168.1.20"), net.ParseIP("fd00::20")},
+		"vpn":     {net.ParseIP("10.8.0.5")},
+	}
+	tests := []struct {
+		name  string
+		order []string
+		want  []string
+	}{
+		{"by address without an order", nil, []string{"10.8.0.5", "172.17.0.2", "192.168.1.20", "fd00::20"}},
+		{"networks", []string{"macvlan", "vpn"}, []string{"192.168.1.20", "fd00::20", "10.8.0.5", "172.17.0.2"}},
+		{"CIDRs", []string{"172.16.0.0/12", "fd00::/64"}, []string{"172.17.0.2", "fd00::20", "10.8.0.5", "192.168.1.20"}},
+		{"networks and CIDRs", []string{"10.0.0.0/8", "macvlan"}, []string{"10.8.0.5", "192.168.1.20", "fd00::20", "172.17.0.2"}},
+		{"unknown entries", []string{"missing", "vpn"}, []string{"10.8.0.5", "172.17.0.2", "192.168.1.20", "fd00::20"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{IPOrder: tt.order, NetworkIPs: networkIPs, IPs: []net.IP{
+				net.ParseIP("fd00::20"), net.ParseIP("192.168.1.20"), net.ParseIP("172.17.0.2"), net.ParseIP("10.8.0.5"),
+			}}
+			s.orderIPs()
+			got := []string{}
+			for _, ip := range s.IPs {
+				got = append(got, ip.String())
+			}
+			equalStrings(t, got, tt.want...)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Sink receives the complete set of services and zones after every change.
+type Sink interface {
+	Name() string
+	Write(set *RecordSet) error
+}
+
+// RecordSet holds the zones of the default view. Views has the zones of each
+// view in COREDOCK_VIEWS, only the zonefile output serves them.
+type RecordSet struct {
+	Services []Service
+	Zones    map[string]*Zone
+	Removed  []string
+	Views    map[string]*RecordSet
+}
+
+func NewSinks(config *Config, db *DB) []Sink {
+	sinks := []Sink{}
+	for _, o := range config.Outputs {
+		switch o {
+		case "zonefile":
+			sinks = append(sinks, NewZoneFileSink(config))
+		case "hosts":
+			sinks = append(sinks, newFileSink(o, config.HostsFile, renderHosts))
+		case "dnsmasq":
+			sinks = append(sinks, newFileSink(o, config.DnsmasqFile, renderDnsmasq))
+		case "unbound":
+			sinks = append(sinks, newFileSink(o, config.UnboundFile, func(set *RecordSet) []byte {
+				return renderUnbound(set, config.UnboundZoneType)
+			}))
+		case "json":
+			sinks = append(sinks, newFileSink(o, config.JSONFile, renderJSON))
+		case "pihole":
+			sinks = append(sinks, newFileSink(o, config.PiholeHostsFile, renderPiholeHosts))
+			sinks = append(sinks, newFileSink(o, config.PiholeCNAMEFile, renderPiholeCNAMEs))
+		case "adguard":
+			adguard := NewAdGuardSink(config, db)
+			go adguard.Run()
+			sinks = append(sinks, adguard)
+		default:
+			logger.Warnf("Ignoring unknown output '%s'", o)
+		}
+	}
+	return sinks
+}
+
+func (r *RecordSet) ZoneNames() []string {
+	names := []string{}
+	for name := range r.Zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *RecordSet) ForwardRecords() []dns.RR {
+	rrs := []dns.RR{}
+	for _, name := range r.ZoneNames() {
+		if strings.HasSuffix(name, ".arpa") {
+			continue
+		}
+		rrs = append(rrs, r.Zones[name].Records...)
+	}
+	return rrs
+}
+
+// ReverseRecords returns the PTR records of all reverse zones. Reverse zones
+// are nested, so the same record is only returned once.
+func (r *RecordSet) ReverseRecords() []dns.RR {
+	rrs := []dns.RR{}
+	for _, name := range r.ZoneNames() {
+		if !strings.HasSuffix(name, ".arpa") {
+			continue
+		}
+		rrs = append(rrs, r.Zones[name].Records...)
+	}
+	return uniqueRecords(rrs)
+}
+
+// fileSink renders the record set into a single file, which is only
+// rewritten if its contents changed.
+type fileSink struct {
+	name   string
+	path   string
+	render func(set *RecordSet) []byte
+}
+
+func newFileSink(name string, path string, render func(set *RecordSet) []byte) *fileSink {
+	return &fileSink{name: name, path: path, render: render}
+}
+
+func (f *fileSink) Name() string {
+	return f.name
+}
+
+func (f *fileSink) Write(set *RecordSet) error {
+	return writeFileIfChanged(f.path, f.render(set))
+}
+
+func writeFileIfChanged(path string, data []byte) error {
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		logger.Debugf("%s unchanged", path)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data, 0o644); err != nil {
+		return err
+	}
+	logger.Infof("Wrote %s", path)
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file next to path and renames it, so
+// readers like CoreDNS never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.example")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader that opened the old file keeps reading it completely.
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if err := writeFileAtomic(path, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(reader); string(data) != "old" {
+		t.Errorf("expected the open file to stay unchanged, got %q", data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("expected the new content, got %q", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o644 {
+		t.Errorf("expected mode 0644, got %s", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left, got %v", entries)
+	}
+}
+
+func TestWriteFileIfChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zones", "hosts")
+	if err := writeFileIfChanged(path, []byte("10.0.0.2 web\n")); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("expected the directory to be created: %v", err)
+	}
+	if err := writeFileIfChanged(path, []byte("10.0.0.2 web\n")); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat(path); !os.SameFile(before, after) {
+		t.Errorf("expected an unchanged file not to be replaced")
+	}
+}
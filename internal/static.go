@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thoas/go-funk"
+)
+
+// loadStaticRecords returns the records that don't belong to a container. Records
+// from a <zone>.zone snippet are keyed by their zone, records from
+// COREDOCK_STATIC_RECORDS by "" and are placed into a zone later.
+func loadStaticRecords(config *Config) map[string][]dns.RR {
+	static := map[string][]dns.RR{}
+
+	for _, raw := range config.StaticRecords {
+		rrs, problems, err := parseRecords(raw, "", config.TTL)
+		if err != nil {
+			logger.Warnf("Ignoring invalid static record '%s': %v", raw, err)
+			continue
+		}
+		for _, p := range problems {
+			logger.Warnf("Ignoring static record '%s': %s", raw, p)
+		}
+		static[""] = append(static[""], rrs...)
+	}
+
+	if config.StaticDir == "" {
+		return static
+	}
+	for _, f := range staticFiles(config) {
+		zone := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(f), ".zone"), ".")
+		data, err := os.ReadFile(f)
+		if err != nil {
+			logger.Warnf("Error reading static records from %s: %v", f, err)
+			continue
+		}
+		rrs, problems, err := parseRecords(string(data), dns.Fqdn(zone), config.TTL)
+		if err != nil {
+			logger.Warnf("Ignoring static records from %s: %v", f, err)
+			continue
+		}
+		for _, p := range problems {
+			logger.Warnf("Ignoring static record from %s: %s", f, p)
+		}
+		static[zone] = append(static[zone], rrs...)
+	}
+	return static
+}
+
+// staticPoll is how often COREDOCK_STATIC_DIR is checked for changes.
+const staticPoll = 10 * time.Second
+
+func staticFiles(config *Config) []string {
+	files, _ := filepath.Glob(filepath.Join(config.StaticDir, "*.zone"))
+	sort.Strings(files)
+	return files
+}
+
+// staticDirHash covers the names and contents of all snippets, so adding,
+// removing and editing a snippet all change it.
+func staticDirHash(config *Config) string {
+	if config.StaticDir == "" {
+		return ""
+	}
+	h := sha256.New()
+	for _, f := range staticFiles(config) {
+		data, _ := os.ReadFile(f)
+		fmt.Fprintf(h, "%s %d\n", f, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// StaticPollInterval is how often StaticChanged needs to be checked, or 0 if
+// there is no COREDOCK_STATIC_DIR.
+func (z *ZoneHandler) StaticPollInterval() time.Duration {
+	if z.config.StaticDir == "" {
+		return 0
+	}
+	return staticPoll
+}
+
+// StaticChanged reports whether the snippets changed since the last Update.
+func (z *ZoneHandler) StaticChanged() bool {
+	z.mux.Lock()
+	defer z.mux.Unlock()
+	return staticDirHash(z.config) != z.staticHash
+}
+
+// parseRecords parses records in zone file syntax. SOA records are managed by
+// coredock, they and records outside of origin are left out and returned as
+// problems for the caller to report.
+func parseRecords(data string, origin string, ttl int) ([]dns.RR, []string, error) {
+	rrs := []dns.RR{}
+	problems := []string{}
+	zp := dns.NewZoneParser(strings.NewReader(fmt.Sprintf("$TTL %d\n%s\n", ttl, data)), origin, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			problems = append(problems, fmt.Sprintf("SOA record for %s is managed by coredock", rr.Header().Name))
+			continue
+		}
+		if origin != "" && !dns.IsSubDomain(origin, rr.Header().Name) {
+			problems = append(problems, fmt.Sprintf("%s is outside of %s", rr.Header().Name, origin))
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, problems, zp.Err()
+}
+
+// staticZones returns the zones a static record goes into. Forward records go
+// into the most specific zone, PTR records into all nested reverse zones.
+func staticZones(name string, zones []string) []string {
+	matches := []string{}
+	for _, zone := range zones {
+		if dns.IsSubDomain(dns.Fqdn(zone), name) {
+			matches = append(matches, zone)
+		}
+	}
+	if len(matches) == 0 || strings.HasSuffix(strings.TrimSuffix(name, "."), ".arpa") {
+		return matches
+	}
+	sort.Slice(matches, func(i, j int) bool { return dns.CountLabel(matches[i]) > dns.CountLabel(matches[j]) })
+	return matches[:1]
+}
+
+// reverseZones returns the /8, /16 and /24 reverse zones of an in-addr.arpa
+// name, or nothing for other names.
+func reverseZones(name string) []string {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	if len(labels) != 6 || labels[4] != "in-addr" || labels[5] != "arpa" {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("%s.in-addr.arpa", labels[3]),
+		fmt.Sprintf("%s.%s.in-addr.arpa", labels[2], labels[3]),
+		fmt.Sprintf("%s.%s.%s.in-addr.arpa", labels[1], labels[2], labels[3]),
+	}
+}
+
+// mergeStaticRecords adds the static records to the generated zones. Names
+// that are already published by a container win, the static record is
+// skipped with a warning.
+func (z *ZoneHandler) mergeStaticRecords(records map[string][]dns.RR, reverseRecords map[string][]dns.RR) {
+	static := loadStaticRecords(z.config)
+	if len(static) == 0 {
+		return
+	}
+
+	zoneMap := func(zone string) map[string][]dns.RR {
+		if strings.HasSuffix(zone, ".arpa") {
+			return reverseRecords
+		}
+		return records
+	}
+
+	containerNames := map[string]bool{}
+	for _, m := range []map[string][]dns.RR{records, reverseRecords} {
+		for zone, rrs := range m {
+			for _, rr := range rrs {
+				containerNames[zone+"/"+strings.ToLower(rr.Header().Name)] = true
+			}
+		}
+	}
+
+	zones := []string{}
+	for zone := range static {
+		if zone == "" {
+			continue
+		}
+		if _, ok := zoneMap(zone)[zone]; !ok {
+			zoneMap(zone)[zone] = []dns.RR{}
+		}
+	}
+	// Static PTR records get the same reverse zones as containers.
+	for _, rr := range static[""] {
+		if rr.Header().Rrtype != dns.TypePTR {
+			continue
+		}
+		for _, zone := range reverseZones(rr.Header().Name) {
+			if _, ok := reverseRecords[zone]; !ok {
+				reverseRecords[zone] = []dns.RR{}
+			}
+		}
+	}
+	for _, m := range []map[string][]dns.RR{records, reverseRecords} {
+		for zone := range m {
+			zones = append(zones, zone)
+		}
+	}
+	for _, domain := range z.config.Domains {
+		if _, ok := records[domain]; !ok {
+			zones = append(zones, domain)
+		}
+	}
+
+	keys := funk.Keys(static).([]string)
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, rr := range static[key] {
+			name := rr.Header().Name
+			targets := []string{key}
+			if key == "" {
+				targets = staticZones(name, zones)
+			}
+			if len(targets) == 0 && rr.Header().Rrtype == dns.TypePTR {
+				logger.Warnf("Ignoring static record '%s', reverse zones are only created for IPv4 addresses", rr)
+				continue
+			}
+			if len(targets) == 0 || !dns.IsSubDomain(dns.Fqdn(targets[0]), name) {
+				logger.Warnf("Ignoring static record '%s', it doesn't belong to any zone", rr)
+				continue
+			}
+			for _, zone := range targets {
+				if containerNames[zone+"/"+strings.ToLower(name)] {
+					logger.Warnf("Ignoring static record '%s', %s is already published by a container", rr, name)
+					continue
+				}
+				zoneMap(zone)[zone] = append(zoneMap(zone)[zone], rr)
+			}
+		}
+	}
+}
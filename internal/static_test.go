@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReverseZones(t *testing.T) {
+	equalStrings(t, reverseZones("5.0.0.10.in-addr.arpa."), "10.in-addr.arpa", "0.10.in-addr.arpa", "0.0.10.in-addr.arpa")
+	equalStrings(t, reverseZones("0.10.in-addr.arpa."))
+	equalStrings(t, reverseZones("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."))
+}
+
+func TestStaticPTRRecordsGetReverseZones(t *testing.T) {
+	z := NewZoneHandler(&Config{TTL: 300, Domains: []string{"docker.lan"}, StaticRecords: []string{
+		"nas.docker.lan. IN A 10.0.0.5",
+		"5.0.0.10.in-addr.arpa. IN PTR nas.docker.lan.",
+	}}, newTestDB(t), nil)
+	records := map[string][]dns.RR{}
+	reverseRecords := map[string][]dns.RR{}
+	z.mergeStaticRecords(records, reverseRecords)
+
+	equalRRs(t, records["docker.lan"], mustRRs(t, "nas.docker.lan. 300 IN A 10.0.0.5"))
+	for _, zone := range []string{"10.in-addr.arpa", "0.10.in-addr.arpa", "0.0.10.in-addr.arpa"} {
+		equalRRs(t, reverseRecords[zone], mustRRs(t, "5.0.0.10.in-addr.arpa. 300 IN PTR nas.docker.lan."))
+	}
+}
+
+func TestStaticChanged(t *testing.T) {
+	dir := t.TempDir()
+	z := NewZoneHandler(&Config{TTL: 300, StaticDir: dir}, newTestDB(t), nil)
+	d := NewDNSProvider(z.config)
+	path := filepath.Join(dir, "docker.lan.zone")
+	if err := os.WriteFile(path, []byte("nas IN A 10.0.0.5\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !z.StaticChanged() {
+		t.Fatalf("expected a new snippet to be a change")
+	}
+
+	z.Update(&[]Service{}, d)
+	if z.StaticChanged() {
+		t.Fatalf("expected no change after an update")
+	}
+
+	if err := os.WriteFile(path, []byte("nas IN A 10.0.0.6\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !z.StaticChanged() {
+		t.Fatalf("expected an edited snippet to be a change")
+	}
+	z.Update(&[]Service{}, d)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if !z.StaticChanged() {
+		t.Fatalf("expected a removed snippet to be a change")
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	rrs, problems, err := parseRecords("web IN A 10.0.0.2\n@ IN SOA ns.example. hostmaster.example. 1 2 3 4 5\nother.test. IN A 10.0.0.1", "example.", 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equalRRs(t, rrs, mustRRs(t, "web.example. 300 IN A 10.0.0.2"))
+	equalStrings(t, problems, "SOA record for example. is managed by coredock", "other.test. is outside of example.")
+
+	if _, _, err := parseRecords("broken IN A not-an-ip", "example.", 300); err == nil {
+		t.Fatalf("expected an error for an invalid record")
+	}
+}
@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Number of serial changes kept per zone to answer IXFR requests. Older
+// serials get a full zone transfer instead.
+const ixfrHistory = 20
+
+type TransferServer struct {
+	config *Config
+	allow  []*net.IPNet
+	zones  map[string]*transferZone
+	mux    sync.RWMutex
+}
+
+type transferZone struct {
+	soa     *dns.SOA
+	records []dns.RR
+	deltas  []ixfrDelta
+}
+
+type ixfrDelta struct {
+	from    *dns.SOA
+	to      *dns.SOA
+	removed []dns.RR
+	added   []dns.RR
+}
+
+func NewTransferServer(config *Config) *TransferServer {
+	if config.TransferListen == "" {
+		return nil
+	}
+
+	allow := []*net.IPNet{}
+	for _, a := range config.TransferAllow {
+		if !strings.Contains(a, "/") {
+			if strings.Contains(a, ":") {
+				a += "/128"
+			} else {
+				a += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			logger.Errorf("Ignoring invalid transfer ACL entry '%s': %v", a, err)
+			continue
+		}
+		allow = append(allow, n)
+	}
+	if len(allow) == 0 {
+		logger.Warnf("Zone transfers enabled on %s, but COREDOCK_TRANSFER_ALLOW is empty. All transfers will be refused.", config.TransferListen)
+	}
+
+	return &TransferServer{config: config, allow: allow, zones: map[string]*transferZone{}}
+}
+
+func (t *TransferServer) Run() error {
+	errChan := make(chan error, 2)
+	for _, n := range []string{"tcp", "udp"} {
+		server := &dns.Server{Addr: t.config.TransferListen, Net: n, Handler: t}
+		go func() {
+			errChan <- server.ListenAndServe()
+		}()
+	}
+	logger.Infof("Serving zone transfers on %s", t.config.TransferListen)
+	return <-errChan
+}
+
+func (t *TransferServer) Name() string {
+	return "transfer"
+}
+
+func (t *TransferServer) Write(set *RecordSet) error {
+	for _, zone := range set.ZoneNames() {
+		t.Update(zone, set.Zones[zone].SOA.(*dns.SOA), set.Zones[zone].Records, set.Zones[zone].Changed)
+	}
+	for _, zone := range set.Removed {
+		t.Remove(zone)
+	}
+	return nil
+}
+
+// Update loads the current state of a zone. If the serial changed, the
+// difference to the previous state is kept for IXFR. Secondaries are only
+// notified of changed zones, not of zones loaded on startup.
+func (t *TransferServer) Update(zone string, soa *dns.SOA, records []dns.RR, changed bool) {
+	name := strings.ToLower(dns.Fqdn(zone))
+
+	t.mux.Lock()
+	prev, ok := t.zones[name]
+	if ok && prev.soa.Serial == soa.Serial {
+		t.mux.Unlock()
+		return
+	}
+
+	z := &transferZone{soa: soa, records: records}
+	if ok {
+		removed, added := diffRecords(prev.records, records)
+		z.deltas = append(prev.deltas, ixfrDelta{from: prev.soa, to: soa, removed: removed, added: added})
+		if len(z.deltas) > ixfrHistory {
+			z.deltas = z.deltas[len(z.deltas)-ixfrHistory:]
+		}
+	}
+	t.zones[name] = z
+	t.mux.Unlock()
+
+	if changed {
+		t.notify(name, soa)
+	}
+}
+
+func (t *TransferServer) Remove(zone string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	delete(t.zones, strings.ToLower(dns.Fqdn(zone)))
+}
+
+func (t *TransferServer) notify(zone string, soa *dns.SOA) {
+	for _, target := range t.config.TransferNotify {
+		go func() {
+			m := new(dns.Msg)
+			m.SetNotify(zone)
+			m.Answer = []dns.RR{soa}
+			c := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+			r, _, err := c.Exchange(m, target)
+			if err != nil {
+				logger.Warnf("Error sending NOTIFY for %s to %s: %v", zone, target, err)
+				return
+			}
+			if r.Rcode != dns.RcodeSuccess {
+				logger.Warnf("NOTIFY for %s refused by %s: %s", zone, target, dns.RcodeToString[r.Rcode])
+				return
+			}
+			logger.Debugf("Sent NOTIFY for %s serial %d to %s", zone, soa.Serial, target)
+		}()
+	}
+}
+
+func (t *TransferServer) isAllowed(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range t.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TransferServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	if len(r.Question) != 1 {
+		w.WriteMsg(m.SetRcodeFormatError(r))
+		return
+	}
+	q := r.Question[0]
+
+	t.mux.RLock()
+	z, ok := t.zones[strings.ToLower(q.Name)]
+	t.mux.RUnlock()
+	if !ok {
+		w.WriteMsg(m.SetRcode(r, dns.RcodeNotAuth))
+		return
+	}
+
+	switch q.Qtype {
+	case dns.TypeSOA:
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{z.soa}
+		w.WriteMsg(m)
+		return
+	case dns.TypeAXFR, dns.TypeIXFR:
+	default:
+		w.WriteMsg(m.SetRcode(r, dns.RcodeRefused))
+		return
+	}
+
+	if !t.isAllowed(w.RemoteAddr()) {
+		logger.Warnf("Refused %s of %s for %s", dns.TypeToString[q.Qtype], q.Name, w.RemoteAddr())
+		w.WriteMsg(m.SetRcode(r, dns.RcodeRefused))
+		return
+	}
+
+	rrs := z.axfr()
+	if q.Qtype == dns.TypeIXFR {
+		rrs = z.ixfr(r)
+	}
+
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		if q.Qtype == dns.TypeAXFR {
+			w.WriteMsg(m.SetRcode(r, dns.RcodeRefused))
+			return
+		}
+		// Only the SOA is sent over UDP, clients retry over TCP if they're behind.
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{z.soa}
+		w.WriteMsg(m)
+		return
+	}
+
+	logger.Infof("Sending %s of %s serial %d to %s", dns.TypeToString[q.Qtype], q.Name, z.soa.Serial, w.RemoteAddr())
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- tr.Out(w, r, ch)
+	}()
+	// Out returns early if the client goes away, stop sending then.
+	var err error
+	done := false
+	for len(rrs) > 0 && !done {
+		n := min(len(rrs), 200)
+		select {
+		case ch <- &dns.Envelope{RR: rrs[:n]}:
+			rrs = rrs[n:]
+		case err = <-errChan:
+			done = true
+		}
+	}
+	close(ch)
+	if !done {
+		err = <-errChan
+	}
+	if err != nil {
+		logger.Errorf("Error sending %s of %s to %s: %v", dns.TypeToString[q.Qtype], q.Name, w.RemoteAddr(), err)
+	}
+	w.Close()
+}
+
+func (z *transferZone) axfr() []dns.RR {
+	rrs := []dns.RR{z.soa}
+	rrs = append(rrs, z.records...)
+	return append(rrs, z.soa)
+}
+
+// ixfr builds an incremental transfer from the client's serial, falling back
+// to a full transfer if that serial is not in the history anymore.
+func (z *transferZone) ixfr(r *dns.Msg) []dns.RR {
+	if len(r.Ns) == 0 {
+		return z.axfr()
+	}
+	clientSOA, ok := r.Ns[0].(*dns.SOA)
+	if !ok {
+		return z.axfr()
+	}
+	if clientSOA.Serial == z.soa.Serial {
+		return []dns.RR{z.soa}
+	}
+
+	for i, delta := range z.deltas {
+		if delta.from.Serial != clientSOA.Serial {
+			continue
+		}
+		rrs := []dns.RR{z.soa}
+		for _, d := range z.deltas[i:] {
+			rrs = append(rrs, d.from)
+			rrs = append(rrs, d.removed...)
+			rrs = append(rrs, d.to)
+			rrs = append(rrs, d.added...)
+		}
+		return append(rrs, z.soa)
+	}
+	return z.axfr()
+}
+
+func diffRecords(old []dns.RR, new []dns.RR) ([]dns.RR, []dns.RR) {
+	oldSet := map[string]bool{}
+	for _, r := range old {
+		oldSet[r.String()] = true
+	}
+	newSet := map[string]bool{}
+	for _, r := range new {
+		newSet[r.String()] = true
+	}
+
+	removed := []dns.RR{}
+	for _, r := range old {
+		if !newSet[r.String()] {
+			removed = append(removed, r)
+		}
+	}
+	added := []dns.RR{}
+	for _, r := range new {
+		if !oldSet[r.String()] {
+			added = append(added, r)
+		}
+	}
+	return removed, added
+}
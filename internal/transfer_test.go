@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("invalid record '%s': %v", s, err)
+	}
+	return rr
+}
+
+func mustRRs(t *testing.T, records ...string) []dns.RR {
+	t.Helper()
+	rrs := []dns.RR{}
+	for _, r := range records {
+		rrs = append(rrs, mustRR(t, r))
+	}
+	return rrs
+}
+
+func testSOA(t *testing.T, serial uint32) *dns.SOA {
+	t.Helper()
+	return mustRR(t, fmt.Sprintf("example. 300 IN SOA coredock.example. hostmaster.example. %d 28800 7200 604800 300", serial)).(*dns.SOA)
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	s := []string{}
+	for _, r := range rrs {
+		s = append(s, r.String())
+	}
+	return s
+}
+
+func equalRRs(t *testing.T, got []dns.RR, want []dns.RR) {
+	t.Helper()
+	g, w := rrStrings(got), rrStrings(want)
+	if len(g) != len(w) {
+		t.Fatalf("got %d records, want %d:\n got: %v\nwant: %v", len(g), len(w), g, w)
+	}
+	for i := range g {
+		if g[i] != w[i] {
+			t.Fatalf("record %d differs:\n got: %s\nwant: %s", i, g[i], w[i])
+		}
+	}
+}
+
+func TestDiffRecords(t *testing.T) {
+	old := mustRRs(t, "a.example. 300 IN A 10.0.0.1", "b.example. 300 IN A 10.0.0.2")
+	new := mustRRs(t, "b.example. 300 IN A 10.0.0.2", "c.example. 300 IN A 10.0.0.3")
+
+	removed, added := diffRecords(old, new)
+	equalRRs(t, removed, mustRRs(t, "a.example. 300 IN A 10.0.0.1"))
+	equalRRs(t, added, mustRRs(t, "c.example. 300 IN A 10.0.0.3"))
+
+	removed, added = diffRecords(new, new)
+	if len(removed) != 0 || len(added) != 0 {
+		t.Fatalf("expected no difference, got -%v +%v", removed, added)
+	}
+}
+
+func ixfrRequest(serial uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetIxfr("example.", serial, "coredock.example.", "hostmaster.example.")
+	return m
+}
+
+func TestIXFR(t *testing.T) {
+	ts := &TransferServer{config: &Config{}, zones: map[string]*transferZone{}}
+	v1 := mustRRs(t, "a.example. 300 IN A 10.0.0.1")
+	v2 := mustRRs(t, "a.example. 300 IN A 10.0.0.1", "b.example. 300 IN A 10.0.0.2")
+	v3 := mustRRs(t, "b.example. 300 IN A 10.0.0.2")
+	ts.Update("example", testSOA(t, 1), v1, false)
+	ts.Update("example", testSOA(t, 2), v2, true)
+	ts.Update("example", testSOA(t, 3), v3, true)
+	z := ts.zones["example."]
+
+	tests := []struct {
+		name   string
+		serial uint32
+		want   []dns.RR
+	}{
+		{"up to date", 3, []dns.RR{testSOA(t, 3)}},
+		{"one behind", 2, []dns.RR{
+			testSOA(t, 3),
+			testSOA(t, 2), mustRR(t, "a.example. 300 IN A 10.0.0.1"),
+			testSOA(t, 3),
+			testSOA(t, 3),
+		}},
+		{"two behind", 1, []dns.RR{
+			testSOA(t, 3),
+			testSOA(t, 1),
+			testSOA(t, 2), mustRR(t, "b.example. 300 IN A 10.0.0.2"),
+			testSOA(t, 2), mustRR(t, "a.example. 300 IN A 10.0.0.1"),
+			testSOA(t, 3),
+			testSOA(t, 3),
+		}},
+		{"unknown serial falls back to AXFR", 42, append(append([]dns.RR{testSOA(t, 3)}, v3...), testSOA(t, 3))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			equalRRs(t, z.ixfr(ixfrRequest(tt.serial)), tt.want)
+		})
+	}
+}
+
+func TestIXFRHistoryIsBounded(t *testing.T) {
+	ts := &TransferServer{config: &Config{}, zones: map[string]*transferZone{}}
+	for serial := uint32(1); serial <= ixfrHistory+5; serial++ {
+		ts.Update("example", testSOA(t, serial), mustRRs(t, fmt.Sprintf("a.example. 300 IN TXT \"%d\"", serial)), true)
+	}
+	z := ts.zones["example."]
+	if len(z.deltas) != ixfrHistory {
+		t.Fatalf("expected %d deltas, got %d", ixfrHistory, len(z.deltas))
+	}
+	// Serial 1 is gone from the history, so a full transfer is sent.
+	got := z.ixfr(ixfrRequest(1))
+	equalRRs(t, got, z.axfr())
+}
+
+func startTransferServer(t *testing.T, ts *TransferServer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: l, Handler: ts, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return l.Addr().String()
+}
+
+func TestAXFR(t *testing.T) {
+	ts := NewTransferServer(&Config{TransferListen: "127.0.0.1:0", TransferAllow: []string{"127.0.0.1"}})
+	records := []dns.RR{}
+	for i := 0; i < 450; i++ {
+		records = append(records, mustRR(t, fmt.Sprintf("host%d.example. 300 IN A 10.0.%d.%d", i, i/250, i%250+1)))
+	}
+	ts.Update("example", testSOA(t, 7), records, false)
+	addr := startTransferServer(t, ts)
+
+	m := new(dns.Msg)
+	m.SetAxfr("example.")
+	envelopes, err := new(dns.Transfer).In(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []dns.RR{}
+	for e := range envelopes {
+		if e.Error != nil {
+			t.Fatal(e.Error)
+		}
+		got = append(got, e.RR...)
+	}
+	equalRRs(t, got, ts.zones["example."].axfr())
+}
+
+func TestAXFRRefused(t *testing.T) {
+	ts := NewTransferServer(&Config{TransferListen: "127.0.0.1:0", TransferAllow: []string{"10.0.0.0/8"}})
+	ts.Update("example", testSOA(t, 1), mustRRs(t, "a.example. 300 IN A 10.0.0.1"), false)
+	addr := startTransferServer(t, ts)
+
+	m := new(dns.Msg)
+	m.SetAxfr("example.")
+	envelopes, err := new(dns.Transfer).In(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := <-envelopes
+	if e.Error == nil {
+		t.Fatalf("expected the transfer to be refused, got %v", e.RR)
+	}
+}
+
+// failingWriter fails every write, like a client that went away.
+type failingWriter struct{}
+
+var loopback = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+
+func (failingWriter) LocalAddr() net.Addr       { return loopback }
+func (failingWriter) RemoteAddr() net.Addr      { return loopback }
+func (failingWriter) WriteMsg(*dns.Msg) error   { return errors.New("connection reset") }
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("connection reset") }
+func (failingWriter) Close() error              { return nil }
+func (failingWriter) TsigStatus() error         { return nil }
+func (failingWriter) TsigTimersOnly(bool)       {}
+func (failingWriter) Hijack()                   {}
+
+func TestAXFRClientGone(t *testing.T) {
+	ts := NewTransferServer(&Config{TransferListen: "127.0.0.1:0", TransferAllow: []string{"127.0.0.1"}})
+	records := []dns.RR{}
+	for i := 0; i < 1000; i++ {
+		records = append(records, mustRR(t, fmt.Sprintf("host%d.example. 300 IN TXT \"%d\"", i, i)))
+	}
+	ts.Update("example", testSOA(t, 1), records, false)
+
+	m := new(dns.Msg)
+	m.SetAxfr("example.")
+	done := make(chan struct{})
+	go func() {
+		ts.ServeDNS(failingWriter{}, m)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeDNS did not return after the client went away")
+	}
+}
+
+func TestNotifyOnlyChangedZones(t *testing.T) {
+	var mux sync.Mutex
+	serials := []uint32{}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		mux.Lock()
+		serials = append(serials, r.Answer[0].(*dns.SOA).Serial)
+		mux.Unlock()
+		m := new(dns.Msg)
+		w.WriteMsg(m.SetReply(r))
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	ts := NewTransferServer(&Config{TransferListen: "127.0.0.1:0", TransferNotify: []string{pc.LocalAddr().String()}})
+	ts.Update("example", testSOA(t, 1), nil, false)
+	ts.Update("example", testSOA(t, 2), nil, true)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		mux.Lock()
+		n := len(serials)
+		mux.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	mux.Lock()
+	defer mux.Unlock()
+	if len(serials) != 1 || serials[0] != 2 {
+		t.Fatalf("expected a single NOTIFY for serial 2, got %v", serials)
+	}
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thoas/go-funk"
+)
+
+// Failed updates are retried after this interval.
+const updateRetry = 30 * time.Second
+
+// DynamicUpdater pushes records into an external authoritative server with
+// RFC 2136 UPDATE messages. Only the difference to the last successfully
+// pushed record set of a zone is sent. Updates are sent in the background,
+// so an unreachable server doesn't hold up the other outputs.
+type DynamicUpdater struct {
+	config   *Config
+	db       *DB
+	client   *dns.Client
+	provider *DNSProvider
+	pending  map[string][]dns.RR
+	wake     chan struct{}
+	mux      sync.Mutex
+}
+
+func NewDynamicUpdater(config *Config, db *DB) *DynamicUpdater {
+	if config.RFC2136Server == "" {
+		return nil
+	}
+
+	client := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	if config.RFC2136TSIGName != "" {
+		client.TsigSecret = map[string]string{dns.Fqdn(config.RFC2136TSIGName): config.RFC2136TSIGSecret}
+	}
+	return &DynamicUpdater{config: config, db: db, client: client, provider: NewDNSProvider(config), pending: map[string][]dns.RR{}, wake: make(chan struct{}, 1)}
+}
+
+func (u *DynamicUpdater) handles(zone string) bool {
+	if len(u.config.RFC2136Zones) > 0 {
+		return funk.ContainsString(u.config.RFC2136Zones, zone)
+	}
+	return !strings.HasSuffix(zone, ".arpa")
+}
+
+func (u *DynamicUpdater) Name() string {
+	return "rfc2136"
+}
+
+// Write queues the zones for the next push. Zones that were pushed before,
+// but are gone now, are emptied. Their records stay in the DB until that
+// succeeded, so a failed removal is retried, even after a restart.
+func (u *DynamicUpdater) Write(set *RecordSet) error {
+	u.mux.Lock()
+	for _, zone := range set.ZoneNames() {
+		if u.handles(zone) {
+			u.pending[zone] = u.filter(zone, set.Zones[zone].Records)
+		}
+	}
+	for _, zone := range u.db.PushedZones() {
+		if _, ok := set.Zones[zone]; !ok && u.handles(zone) {
+			u.pending[zone] = []dns.RR{}
+		}
+	}
+	u.mux.Unlock()
+
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// The external server signs its zones itself, and has its own apex NS and
+// nameserver addresses.
+func (u *DynamicUpdater) filter(zone string, records []dns.RR) []dns.RR {
+	return funk.Filter(records, func(r dns.RR) bool {
+		t := r.Header().Rrtype
+		return t != dns.TypeRRSIG && t != dns.TypeNSEC && t != dns.TypeDNSKEY && !u.provider.IsApexRecord(zone, r)
+	}).([]dns.RR)
+}
+
+func (u *DynamicUpdater) Run() {
+	ticker := time.NewTicker(updateRetry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.wake:
+		case <-ticker.C:
+		}
+		u.flush()
+	}
+}
+
+// flush pushes all queued zones. Zones that failed are queued again, unless
+// a newer record set arrived in the meantime.
+func (u *DynamicUpdater) flush() {
+	u.mux.Lock()
+	pending := u.pending
+	u.pending = map[string][]dns.RR{}
+	u.mux.Unlock()
+
+	zones := funk.Keys(pending).([]string)
+	sort.Strings(zones)
+	for _, zone := range zones {
+		if err := u.Update(zone, pending[zone]); err != nil {
+			logger.Errorf("RFC2136: Error updating zone %s on %s, retrying in %s: %v", zone, u.config.RFC2136Server, updateRetry, err)
+			u.mux.Lock()
+			if _, ok := u.pending[zone]; !ok {
+				u.pending[zone] = pending[zone]
+			}
+			u.mux.Unlock()
+		}
+	}
+}
+
+func (u *DynamicUpdater) Update(zone string, records []dns.RR) error {
+	last := []dns.RR{}
+	for _, s := range u.db.PushedRecords(zone) {
+		rr, err := dns.NewRR(s)
+		if err != nil || rr == nil {
+			continue
+		}
+		last = append(last, rr)
+	}
+
+	removed, added := diffRecords(last, records)
+	if len(removed) == 0 && len(added) == 0 {
+		logger.Debugf("RFC2136: Zone %s unchanged", zone)
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	if len(removed) > 0 {
+		m.Remove(removed)
+	}
+	if len(added) > 0 {
+		m.Insert(added)
+	}
+	if u.config.RFC2136TSIGName != "" {
+		m.SetTsig(dns.Fqdn(u.config.RFC2136TSIGName), dns.Fqdn(u.config.RFC2136TSIGAlgorithm), 300, time.Now().Unix())
+	}
+
+	if err := u.send(m); err != nil {
+		return err
+	}
+	logger.Infof("RFC2136: Updated zone %s on %s, %d removed, %d added", zone, u.config.RFC2136Server, len(removed), len(added))
+
+	u.db.SetPushedRecords(zone, funk.Map(records, func(r dns.RR) string { return r.String() }).([]string))
+	return nil
+}
+
+func (u *DynamicUpdater) send(m *dns.Msg) error {
+	r, _, err := u.client.Exchange(m, u.config.RFC2136Server)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("server responded with %s", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
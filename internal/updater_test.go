@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testTSIGName   = "coredock."
+	testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+// fakePrimary applies RFC 2136 updates to an in-memory zone, and only accepts
+// updates signed with the test key.
+type fakePrimary struct {
+	mux     sync.Mutex
+	records map[string]bool
+	refuse  bool
+}
+
+func (f *fakePrimary) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if r.IsTsig() == nil || w.TsigStatus() != nil || f.refuse {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+	for _, rr := range r.Ns {
+		if rr.Header().Class == dns.ClassNONE {
+			// Deletions carry a TTL of 0, IsDuplicate ignores it.
+			rr.Header().Class = dns.ClassINET
+			for existing := range f.records {
+				if e, _ := dns.NewRR(existing); dns.IsDuplicate(e, rr) {
+					delete(f.records, existing)
+				}
+			}
+			continue
+		}
+		f.records[rr.String()] = true
+	}
+	m.SetTsig(testTSIGName, dns.HmacSHA256, 300, time.Now().Unix())
+	w.WriteMsg(m)
+}
+
+func (f *fakePrimary) setRefuse(refuse bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.refuse = refuse
+}
+
+func (f *fakePrimary) list() []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	list := []string{}
+	for r := range f.records {
+		list = append(list, r)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func startFakePrimary(t *testing.T) (*fakePrimary, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := &fakePrimary{records: map[string]bool{}}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          l,
+		Handler:           primary,
+		TsigSecret:        map[string]string{testTSIGName: testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// The default only accepts queries and notifies.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return primary, l.Addr().String()
+}
+
+func testUpdater(t *testing.T, addr string) *DynamicUpdater {
+	t.Helper()
+	return NewDynamicUpdater(&Config{
+		NSAddresses:          []string{"10.0.0.53"},
+		RFC2136Server:        addr,
+		RFC2136TSIGName:      "coredock",
+		RFC2136TSIGSecret:    testTSIGSecret,
+		RFC2136TSIGAlgorithm: dns.HmacSHA256,
+	}, newTestDB(t))
+}
+
+func zoneSet(t *testing.T, zones map[string][]string) *RecordSet {
+	t.Helper()
+	set := &RecordSet{Zones: map[string]*Zone{}}
+	for name, records := range zones {
+		set.Zones[name] = &Zone{Name: name, SOA: testSOA(t, 1), Records: mustRRs(t, records...)}
+	}
+	return set
+}
+
+func TestDynamicUpdater(t *testing.T) {
+	primary, addr := startFakePrimary(t)
+	u := testUpdater(t, addr)
+
+	// Added records are pushed, DNSSEC, apex NS and glue records are not.
+	u.Write(zoneSet(t, map[string][]string{
+		"example": {
+			"example. 300 IN NS ns.example.",
+			"ns.example. 300 IN A 10.0.0.53",
+			"web.example. 300 IN A 10.0.0.2",
+			"app.example. 300 IN A 10.0.0.3",
+			"example. 300 IN NSEC web.example. NS RRSIG NSEC",
+		},
+		"0.0.10.in-addr.arpa": {"2.0.0.10.in-addr.arpa. 300 IN PTR web.example."},
+	}))
+	u.flush()
+	equalStrings(t, primary.list(), "app.example.\t300\tIN\tA\t10.0.0.3", "web.example.\t300\tIN\tA\t10.0.0.2")
+
+	// Removed records are deleted.
+	u.Write(zoneSet(t, map[string][]string{"example": {"web.example. 300 IN A 10.0.0.2"}}))
+	u.flush()
+	equalStrings(t, primary.list(), "web.example.\t300\tIN\tA\t10.0.0.2")
+
+	// Removed zones are emptied and forgotten.
+	u.Write(zoneSet(t, map[string][]string{}))
+	u.flush()
+	equalStrings(t, primary.list())
+	equalStrings(t, u.db.PushedZones())
+}
+
+func TestDynamicUpdaterRetriesRemovedZones(t *testing.T) {
+	primary, addr := startFakePrimary(t)
+	u := testUpdater(t, addr)
+
+	u.Write(zoneSet(t, map[string][]string{"example": {"web.example. 300 IN A 10.0.0.2"}}))
+	u.flush()
+
+	// The zone is removed while the server refuses updates.
+	primary.setRefuse(true)
+	u.Write(zoneSet(t, map[string][]string{}))
+	u.flush()
+	equalStrings(t, primary.list(), "web.example.\t300\tIN\tA\t10.0.0.2")
+	equalStrings(t, u.db.PushedZones(), "example")
+
+	// The next attempt succeeds.
+	primary.setRefuse(false)
+	u.flush()
+	equalStrings(t, primary.list())
+	equalStrings(t, u.db.PushedZones())
+}
+
+func TestDynamicUpdaterRejectsWrongKey(t *testing.T) {
+	primary, addr := startFakePrimary(t)
+	u := testUpdater(t, addr)
+	u.client.TsigSecret = map[string]string{testTSIGName: "d3Jvbmd3cm9uZ3dyb25nd3Jvbmc="}
+	u.config.RFC2136TSIGSecret = "d3Jvbmd3cm9uZ3dyb25nd3Jvbmc="
+
+	u.Write(zoneSet(t, map[string][]string{"example": {"web.example. 300 IN A 10.0.0.2"}}))
+	u.flush()
+	equalStrings(t, primary.list())
+	equalStrings(t, u.db.PushedZones())
+	if _, ok := u.pending["example"]; !ok {
+		t.Fatalf("expected the failed zone to be queued again")
+	}
+}
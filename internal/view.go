@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/thoas/go-funk"
+)
+
+// View serves the IPs of its networks to clients from its subnets.
+type View struct {
+	Name     string
+	CIDRs    []string
+	Networks []string
+}
+
+// parseViews parses name:cidrs:networks entries separated by ";". CIDRs may
+// contain colons themselves, so the networks are taken after the last one.
+func parseViews(s string) []View {
+	views := []View{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, ":")
+		idx := strings.LastIndex(rest, ":")
+		if !ok || idx < 0 || strings.TrimSpace(name) == "" {
+			logger.Warnf("Ignoring invalid view '%s', expected name:cidrs:networks", entry)
+			continue
+		}
+		view := View{Name: strings.TrimSpace(name), Networks: splitList(rest[idx+1:])}
+		for _, cidr := range splitList(rest[:idx]) {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				logger.Warnf("Ignoring invalid CIDR '%s' of view '%s'", cidr, view.Name)
+				continue
+			}
+			view.CIDRs = append(view.CIDRs, cidr)
+		}
+		if len(view.CIDRs) == 0 || len(view.Networks) == 0 {
+			logger.Warnf("Ignoring view '%s', it needs at least one CIDR and one network", view.Name)
+			continue
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// ZoneDir is next to COREDOCK_ZONE_DIR, not inside it, as the auto plugin of
+// the inner CoreDNS loads zone files from subdirectories as well.
+func (v View) ZoneDir(conf *Config) string {
+	return filepath.Join(filepath.Clean(conf.ZoneDir)+"-views", v.Name)
+}
+
+// Filter returns the services with only the IPs they have on the view's
+// networks. Services without any keep all of their IPs, so their names
+// still resolve.
+func (v View) Filter(services []Service) []Service {
+	filtered := []Service{}
+	for _, s := range services {
+		ips := []net.IP{}
+		for _, ip := range s.IPs {
+			for _, nw := range v.Networks {
+				if funk.Contains(s.NetworkIPs[nw], func(i net.IP) bool { return i.Equal(ip) }) {
+					ips = append(ips, ip)
+					break
+				}
+			}
+		}
+		if len(ips) > 0 {
+			s.IPs = ips
+		}
+		filtered = append(filtered, s)
+	}
+	return filtered
+}
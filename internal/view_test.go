@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseViews(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []View
+	}{
+		{"", []View{}},
+		{"lan:192.168.1.0/24:macvlan", []View{{Name: "lan", CIDRs: []string{"192.168.1.0/24"}, Networks: []string{"macvlan"}}}},
+		{"lan:192.168.1.0/24,fd00::/64:macvlan,vpn; internal:172.16.0.0/12:backend", []View{
+			{Name: "lan", CIDRs: []string{"192.168.1.0/24", "fd00::/64"}, Networks: []string{"macvlan", "vpn"}},
+			{Name: "internal", CIDRs: []string{"172.16.0.0/12"}, Networks: []string{"backend"}},
+		}},
+		{"lan:192.168.1.0/24,invalid:macvlan", []View{{Name: "lan", CIDRs: []string{"192.168.1.0/24"}, Networks: []string{"macvlan"}}}},
+		{"lan;:10.0.0.0/8:backend;lan:invalid:macvlan;lan:10.0.0.0/8:", []View{}},
+	}
+	for _, tt := range tests {
+		if got := parseViews(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseViews(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestViewFilter(t *testing.T) {
+	lan, backend := net.ParseIP("192.168.1.10"), net.ParseIP("172.18.0.2")
+	services := []Service{
+		{Name: "both", IPs: []net.IP{lan, backend}, NetworkIPs: map[string][]net.IP{"macvlan": {lan}, "backend": {backend}}},
+		{Name: "backend", IPs: []net.IP{backend}, NetworkIPs: map[string][]net.IP{"backend": {backend}}},
+	}
+	view := View{Name: "lan", CIDRs: []string{"192.168.1.0/24"}, Networks: []string{"macvlan"}}
+
+	filtered := view.Filter(services)
+	if len(filtered) != 2 {
+		t.Fatalf("expected all services, got %d", len(filtered))
+	}
+	if ips := filtered[0].IPs; len(ips) != 1 || !ips[0].Equal(lan) {
+		t.Errorf("expected only the view's IP, got %v", ips)
+	}
+	// Services without an IP on the view's networks keep theirs.
+	if ips := filtered[1].IPs; len(ips) != 1 || !ips[0].Equal(backend) {
+		t.Errorf("expected the service to keep its IPs, got %v", ips)
+	}
+	if len(services[0].IPs) != 2 {
+		t.Errorf("expected the original services to stay unchanged")
+	}
+}
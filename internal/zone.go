@@ -1,81 +1,234 @@
 package internal
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/thoas/go-funk"
 )
 
 type ZoneHandler struct {
 	config *Config
+	db     *DB
+	sinks  []Sink
+	signer *Signer
 	mux    *sync.Mutex
+
+	// staticHash is the content of COREDOCK_STATIC_DIR at the last Update.
+	staticHash string
+}
+
+type Zone struct {
+	Name    string
+	SOA     dns.RR
+	Records []dns.RR
+	Changed bool
 }
 
-func NewZoneHandler(config *Config) *ZoneHandler {
-	return &ZoneHandler{config: config, mux: &sync.Mutex{}}
+func NewZoneHandler(config *Config, db *DB, sinks []Sink) *ZoneHandler {
+	return &ZoneHandler{config: config, db: db, sinks: sinks, signer: NewSigner(config), mux: &sync.Mutex{}}
 }
 
-func CreateZoneDir() error {
-	err := os.MkdirAll("/tmp/coredock", 0o755)
+func CreateZoneDir(config *Config) error {
+	err := os.MkdirAll(config.ZoneDir, 0o755)
 	if err != nil {
-		return fmt.Errorf("error creating /tmp/coredock directory: %s", err)
+		return fmt.Errorf("error creating %s directory: %s", config.ZoneDir, err)
 	}
 
 	return nil
+}
+
+// buildZone bumps the serial of a zone only if its records changed. The last
+// serial is kept in the DB so it never goes backwards, even across restarts.
+func (z *ZoneHandler) buildZone(key string, zone string, records []dns.RR, d *DNSProvider) *Zone {
+	records = funk.Filter(uniqueRecords(records), func(r dns.RR) bool {
+		return dns.IsSubDomain(dns.Fqdn(zone), r.Header().Name)
+	}).([]dns.RR)
+	hash := zoneHash(z.config.TTL, d.GetSOARecord(zone, 0), z.signer != nil, records)
+
+	state := z.db.ZoneState(key)
+	changed := state.Hash != hash
+	if changed {
+		state.Hash = hash
+		state.Serial = nextSerial(state.Serial)
+		logger.Infof("Zone %s changed, serial %d", key, state.Serial)
+	} else if z.signer != nil && z.signer.NeedsResign(state.SignedAt) {
+		changed = true
+		state.Serial = nextSerial(state.Serial)
+		logger.Infof("Zone %s signatures refreshed, serial %d", key, state.Serial)
+	} else {
+		logger.Debugf("Zone %s unchanged, serial %d", key, state.Serial)
+	}
+	if changed {
+		if z.signer != nil {
+			state.SignedAt = time.Now()
+		}
+		z.db.SetZoneState(key, state)
+	}
+
+	soa := d.GetSOARecord(zone, state.Serial)
+	if z.signer != nil {
+		signed, err := z.signer.Sign(key, zone, soa, records)
+		if err != nil {
+			logger.Errorf("DNSSEC: Error signing zone %s, serving it unsigned: %s", key, err)
+		} else {
+			records = signed
+		}
+	}
+
+	return &Zone{Name: zone, SOA: soa, Records: records, Changed: changed}
+}
 
-	// Placeholder function to match the file name.
+func nextSerial(last uint32) uint32 {
+	serial := uint32(time.Now().Unix())
+	if serial <= last {
+		serial = last + 1
+	}
+	return serial
 }
 
-func (z *ZoneHandler) createZoneFile(zone string) error {
-	f := "/tmp/coredock/db." + zone
-	_, err := os.Stat(f)
-	if os.IsNotExist(err) {
-		if err := os.WriteFile(f, []byte(""), 0o644); err != nil {
-			return fmt.Errorf("error creating zone file for zone %s: %s", zone, err)
+func uniqueRecords(records []dns.RR) []dns.RR {
+	seen := map[string]bool{}
+	unique := []dns.RR{}
+	for _, r := range records {
+		key := r.String()
+		if seen[key] {
+			continue
 		}
+		seen[key] = true
+		unique = append(unique, r)
 	}
-	return nil
+	return unique
 }
 
-func (z *ZoneHandler) writeZoneEntry(zone string, soa dns.RR, records []dns.RR) error {
+// zoneHash includes the order of the records, as it is the order of the
+// answers if loadbalance is disabled. Turning DNSSEC on or off and SOA
+// fields other than the serial change the zone as well.
+func zoneHash(ttl int, soa dns.RR, signed bool, records []dns.RR) string {
+	lines := funk.Map(records, func(r dns.RR) string { return r.String() }).([]string)
+	h := sha256.New()
+	fmt.Fprintf(h, "$TTL %d\n", ttl)
+	fmt.Fprintf(h, "%s\n", soa)
+	if signed {
+		fmt.Fprintf(h, "; DNSSEC\n")
+	}
+	for _, l := range lines {
+		h.Write([]byte(l + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ResignInterval is how often Update needs to run without any changes, or 0
+// if zones aren't signed.
+func (z *ZoneHandler) ResignInterval() time.Duration {
+	if z.signer == nil {
+		return 0
+	}
+	return z.signer.ResignInterval()
+}
+
+func (z *ZoneHandler) Update(services *[]Service, d *DNSProvider) {
 	z.mux.Lock()
 	defer z.mux.Unlock()
-	err := z.createZoneFile(zone)
-	if err != nil {
-		return err
+
+	z.staticHash = staticDirHash(z.config)
+	sorted := append([]Service{}, *services...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	set := z.buildRecordSet("", sorted, d)
+	for _, view := range z.config.Views {
+		if set.Views == nil {
+			set.Views = map[string]*RecordSet{}
+		}
+		set.Views[view.Name] = z.buildRecordSet(view.Name, view.Filter(sorted), d)
 	}
 
-	contents := fmt.Sprintf("$ORIGIN %s.\n$TTL %d\n%s\n", zone, z.config.TTL, soa.String())
+	failed := false
+	for _, sink := range z.sinks {
+		if err := sink.Write(set); err != nil {
+			logger.Errorf("Error writing %s output: %s", sink.Name(), err)
+			failed = true
+		}
+	}
+	// Removed zones are forgotten only once every output dropped them, a
+	// failed removal is retried on the next update.
+	if failed {
+		return
+	}
+	z.forgetZones("", set)
+	for name, vs := range set.Views {
+		z.forgetZones(name, vs)
+	}
+}
 
-	for _, r := range records {
-		contents += r.String() + "\n"
+// forgetZones clears the hash of removed zones. Their serial is kept, so a zone
+// continues where it left off if it comes back.
+func (z *ZoneHandler) forgetZones(view string, set *RecordSet) {
+	for _, zone := range set.Removed {
+		key := zoneKey(view, zone)
+		state := z.db.ZoneState(key)
+		state.Hash = ""
+		z.db.SetZoneState(key, state)
+		if z.signer != nil {
+			z.signer.Forget(key)
+		}
 	}
+}
 
-	err = os.WriteFile("/tmp/coredock/db."+zone, []byte(contents), 0o644)
-	if err != nil {
-		return fmt.Errorf("error writing zone file: %s", err)
+// zoneKey is the key of a zone's state. Zones of views have their own state,
+// as they contain different records.
+func zoneKey(view string, zone string) string {
+	if view == "" {
+		return zone
 	}
-	return nil
+	return view + "/" + zone
 }
 
-func (z *ZoneHandler) Update(services *[]Service, d *DNSProvider) {
-	soas := map[string]dns.RR{}
+func (z *ZoneHandler) buildRecordSet(view string, services []Service, d *DNSProvider) *RecordSet {
 	records := map[string][]dns.RR{}
 	reverseRecords := map[string][]dns.RR{}
-	for _, s := range *services {
+	owners := map[string]Service{}
+	ptrOwners := map[string]string{}
+	for _, s := range services {
 
 		if len(s.IPs) == 0 {
-			logger.Warnf("Service '%s' skipped: No valid IP address found.", s.Name)
+			if view == "" {
+				logger.Warnf("Service '%s' skipped: No valid IP address found.", s.Name)
+			}
 			continue
 		}
 		for _, domain := range s.Domains {
 
-			if _, ok := soas[domain]; !ok {
-				soas[domain] = d.GetSOARecord(domain)
+			// The first container with a name keeps it.
+			host := strings.ToLower(s.Name + "." + domain)
+			if owner, ok := owners[host]; ok && owner.ID != s.ID {
+				if view == "" {
+					warnOnce("Service '%s' (%s) skipped in %s: Name is already used by %s", s.Name, shortID(s.ID), domain, shortID(owner.ID))
+				}
+				continue
 			}
+			// The nameserver's name belongs to coredock if it publishes its
+			// addresses.
+			if !s.Self && (z.config.PublishSelf || len(z.config.NSAddresses) > 0) && d.isNSName(domain, host) {
+				if view == "" {
+					warnOnce("Service '%s' (%s) skipped in %s: %s is the name of the nameserver", s.Name, shortID(s.ID), domain, host)
+				}
+				continue
+			}
+			owners[host] = s
 
 			if _, ok := records[domain]; !ok {
 				records[domain] = []dns.RR{}
@@ -84,8 +237,18 @@ func (z *ZoneHandler) Update(services *[]Service, d *DNSProvider) {
 			records[domain] = append(records[domain], d.GetAAAARecords(&s, domain)...)
 			records[domain] = append(records[domain], d.GetCNAMERecords(&s, domain)...)
 			records[domain] = append(records[domain], d.GetSRVRecords(&s, domain)...)
+			records[domain] = append(records[domain], d.GetRawRecords(&s, domain)...)
 
-			for _, ip := range s.IPs {
+			// Containers in the host network share the host's IPs, the first
+			// service with an IP keeps its PTR records.
+			ptrs := funk.Filter(d.GetPTRRecords(&s, domain), func(rr dns.RR) bool {
+				owner, ok := ptrOwners[rr.Header().Name]
+				if !ok {
+					ptrOwners[rr.Header().Name] = s.ID
+				}
+				return !ok || owner == s.ID
+			}).([]dns.RR)
+			for _, ip := range d.ipsFor(&s, domain) {
 				ipstr := ip.String()
 				if !strings.Contains(ipstr, ".") {
 					continue
@@ -111,24 +274,133 @@ func (z *ZoneHandler) Update(services *[]Service, d *DNSProvider) {
 				if _, ok := reverseRecords[zone3]; !ok {
 					reverseRecords[zone3] = []dns.RR{}
 				}
-				reverseRecords[zone1] = append(reverseRecords[zone1], d.GetPTRRecords(&s, domain)...)
-				reverseRecords[zone2] = append(reverseRecords[zone2], d.GetPTRRecords(&s, domain)...)
-				reverseRecords[zone3] = append(reverseRecords[zone3], d.GetPTRRecords(&s, domain)...)
+				reverseRecords[zone1] = append(reverseRecords[zone1], ptrs...)
+				reverseRecords[zone2] = append(reverseRecords[zone2], ptrs...)
+				reverseRecords[zone3] = append(reverseRecords[zone3], ptrs...)
 
 			}
 		}
-		logger.Debugf("Service '%s' added with IPs: %s", s.Name, s.IPs)
-	}
-	for domain, soa := range soas {
-		logger.Debug("Writing soa entries")
-		if err := z.writeZoneEntry(domain, soa, records[domain]); err != nil {
-			logger.Errorf("Error writing zone entry for domain %s: %s", domain, err)
+		if view == "" {
+			logger.Debugf("Service '%s' added with IPs: %s", s.Name, s.IPs)
 		}
 	}
+	z.mergeStaticRecords(records, reverseRecords)
+
+	set := &RecordSet{Services: services, Zones: map[string]*Zone{}}
+	for domain, rrs := range records {
+		rrs = append(d.GetApexRecords(domain, rrs), rrs...)
+		rrs = dropConflictingCNAMEs(domain, rrs, view == "")
+		set.Zones[domain] = z.buildZone(zoneKey(view, domain), domain, rrs, d)
+	}
 	for zone, rrs := range reverseRecords {
-		logger.Debug("Writing reverse zone entries")
-		if err := z.writeZoneEntry(zone, d.GetSOARecord(zone), rrs); err != nil {
-			logger.Errorf("Error writing reverse zone entry for zone %s: %s", zone, err)
+		forward := records[d.nameBase(zone)]
+		rrs = append(d.GetApexRecords(zone, append(append([]dns.RR{}, forward...), rrs...)), rrs...)
+		set.Zones[zone] = z.buildZone(zoneKey(view, zone), zone, rrs, d)
+	}
+
+	// Zones without services or static records are removed.
+	for key, state := range z.db.ZoneStates() {
+		if state.Hash == "" {
+			continue
+		}
+		zone := key
+		if view != "" {
+			zone = strings.TrimPrefix(key, view+"/")
+		}
+		if zoneKey(view, zone) != key || strings.Contains(zone, "/") {
+			continue
+		}
+		if _, ok := set.Zones[zone]; ok {
+			continue
+		}
+		logger.Infof("Zone %s removed, no services left", key)
+		set.Removed = append(set.Removed, zone)
+	}
+	return set
+}
+
+// ZoneFileSink writes one db.<zone> file per zone for the CoreDNS auto plugin.
+// The zones of a view go to View.ZoneDir.
+type ZoneFileSink struct {
+	config  *Config
+	written map[string]uint32
+}
+
+func NewZoneFileSink(config *Config) *ZoneFileSink {
+	return &ZoneFileSink{config: config, written: map[string]uint32{}}
+}
+
+func (z *ZoneFileSink) Name() string {
+	return "zonefile"
+}
+
+func (z *ZoneFileSink) Write(set *RecordSet) error {
+	err := z.writeZones(z.config.ZoneDir, set)
+	for _, view := range z.config.Views {
+		if vs, ok := set.Views[view.Name]; ok {
+			if verr := z.writeZones(view.ZoneDir(z.config), vs); err == nil {
+				err = verr
+			}
 		}
 	}
+	return err
+}
+
+// writeZones returns an error if a zone file couldn't be removed, so the
+// removal is retried.
+func (z *ZoneFileSink) writeZones(dir string, set *RecordSet) error {
+	for _, zone := range set.ZoneNames() {
+		entry := set.Zones[zone]
+		path := filepath.Join(dir, "db."+zone)
+		serial := entry.SOA.(*dns.SOA).Serial
+		// Files removed by someone else are written again.
+		if s, ok := z.written[path]; ok && s == serial && !entry.Changed {
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+		}
+		if err := z.writeZoneEntry(path, zone, entry.SOA, entry.Records); err != nil {
+			logger.Errorf("Error writing zone entry for zone %s: %s", zone, err)
+			continue
+		}
+		logger.Debugf("Wrote zone file %s, serial %d", path, serial)
+		z.written[path] = serial
+	}
+
+	// Files of all other zones are removed, including the ones written before
+	// the zone state was kept in the DB.
+	files, err := filepath.Glob(filepath.Join(dir, "db.*"))
+	if err != nil {
+		return err
+	}
+	var removeErr error
+	for _, path := range files {
+		if _, ok := set.Zones[strings.TrimPrefix(filepath.Base(path), "db.")]; ok {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			removeErr = fmt.Errorf("error removing zone file %s: %s", path, err)
+			continue
+		}
+		logger.Infof("Removed zone file %s", path)
+		delete(z.written, path)
+	}
+	return removeErr
+}
+
+func (z *ZoneFileSink) writeZoneEntry(path string, zone string, soa dns.RR, records []dns.RR) error {
+	contents := fmt.Sprintf("$ORIGIN %s.\n$TTL %d\n%s\n", zone, z.config.TTL, soa.String())
+
+	for _, r := range records {
+		contents += r.String() + "\n"
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error creating zone directory: %s", err)
+	}
+	err := writeFileAtomic(path, []byte(contents), 0o644)
+	if err != nil {
+		return fmt.Errorf("error writing zone file: %s", err)
+	}
+	return nil
 }
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+	"github.com/thoas/go-funk"
+)
+
+func TestSharedIPsHaveOnePTR(t *testing.T) {
+	config := &Config{TTL: 300, Domains: []string{"example"}, HostIPs: []string{"10.0.0.5"}}
+	z := NewZoneHandler(config, newTestDB(t), nil)
+	d := NewDNSProvider(config)
+
+	services := []Service{}
+	for _, name := range []string{"dockerhost", "grafana"} {
+		c := &docker.APIContainers{ID: name + "-id", Names: []string{"/" + name}}
+		c.Networks.Networks = map[string]docker.ContainerNetwork{"host": {}}
+		services = append(services, *NewService(c, "start", config))
+	}
+
+	set := z.buildRecordSet("", services, d)
+	for _, zone := range []string{"10.in-addr.arpa", "0.10.in-addr.arpa", "0.0.10.in-addr.arpa"} {
+		equalRRs(t, set.Zones[zone].Records, mustRRs(t, "5.0.0.10.in-addr.arpa. 300 IN PTR dockerhost.example."))
+	}
+}
+
+func TestNameserverNameIsReserved(t *testing.T) {
+	config := &Config{TTL: 300, Domains: []string{"example"}, NSAddresses: []string{"10.0.0.53"}}
+	z := NewZoneHandler(config, newTestDB(t), nil)
+	d := NewDNSProvider(config)
+
+	services := func() []Service {
+		services := []Service{}
+		for i, name := range []string{"ns", "web"} {
+			c := &docker.APIContainers{ID: name + "-id", Names: []string{"/" + name}}
+			c.Networks.Networks = map[string]docker.ContainerNetwork{"bridge": {IPAddress: fmt.Sprintf("172.17.0.%d", i+2)}}
+			services = append(services, *NewService(c, "start", config))
+		}
+		return services
+	}
+	set := z.buildRecordSet("", services(), d)
+	equalRRs(t, set.Zones["example"].Records, mustRRs(t,
+		"example. 300 IN NS ns.example.",
+		"ns.example. 300 IN A 10.0.0.53",
+		"web.example. 300 IN A 172.17.0.3",
+	))
+
+	// Without addresses for the nameserver, the container may provide them.
+	config.NSAddresses = nil
+	set = z.buildRecordSet("", services(), d)
+	equalRRs(t, set.Zones["example"].Records, mustRRs(t,
+		"example. 300 IN NS ns.example.",
+		"ns.example. 300 IN A 172.17.0.2",
+		"web.example. 300 IN A 172.17.0.3",
+	))
+}
+
+func TestSelfIsPublishedAsNameserver(t *testing.T) {
+	config := &Config{TTL: 300, Domains: []string{"example"}, PublishSelf: true, NSNames: []string{"ns1", "ns2.example.com."}}
+	z := NewZoneHandler(config, newTestDB(t), nil)
+	d := NewDNSProvider(config)
+
+	c := &docker.APIContainers{ID: "self-id", Names: []string{"/coredock"}}
+	c.Networks.Networks = map[string]docker.ContainerNetwork{"bridge": {IPAddress: "172.17.0.53"}}
+	services := NewSelfServices(c, config)
+	for i, name := range []string{"ns1", "web"} {
+		c := &docker.APIContainers{ID: name + "-id", Names: []string{"/" + name}}
+		c.Networks.Networks = map[string]docker.ContainerNetwork{"bridge": {IPAddress: fmt.Sprintf("172.17.0.%d", i+2)}}
+		services = append(services, *NewService(c, "start", config))
+	}
+
+	set := z.buildRecordSet("", services, d)
+	if mname := set.Zones["example"].SOA.(*dns.SOA).Ns; mname != "ns1.example." {
+		t.Fatalf("expected ns1.example. as primary nameserver, got %s", mname)
+	}
+	equalRRs(t, set.Zones["example"].Records, mustRRs(t,
+		"example. 300 IN NS ns1.example.",
+		"example. 300 IN NS ns2.example.com.",
+		"ns1.example. 300 IN A 172.17.0.53",
+		"web.example. 300 IN A 172.17.0.3",
+	))
+}
+
+func TestReverseZonesNeedNameserverAddress(t *testing.T) {
+	config := &Config{TTL: 300, Domains: []string{"example"}}
+	z := NewZoneHandler(config, newTestDB(t), nil)
+	d := NewDNSProvider(config)
+
+	c := &docker.APIContainers{ID: "web-id", Names: []string{"/web"}}
+	c.Networks.Networks = map[string]docker.ContainerNetwork{"bridge": {IPAddress: "172.17.0.2"}}
+	web := *NewService(c, "start", config)
+
+	// By default ns.example. has no address, the reverse zones don't delegate
+	// to it either.
+	set := z.buildRecordSet("", []Service{web}, d)
+	equalRRs(t, set.Zones["0.17.172.in-addr.arpa"].Records, mustRRs(t, "2.0.17.172.in-addr.arpa. 300 IN PTR web.example."))
+
+	config.PublishSelf = true
+	self := &docker.APIContainers{ID: "self-id", Names: []string{"/coredock"}}
+	self.Networks.Networks = map[string]docker.ContainerNetwork{"bridge": {IPAddress: "172.17.0.53"}}
+	set = z.buildRecordSet("", append(NewSelfServices(self, config), web), d)
+	equalRRs(t, set.Zones["0.17.172.in-addr.arpa"].Records, mustRRs(t,
+		"0.17.172.in-addr.arpa. 300 IN NS ns.example.",
+		"53.0.17.172.in-addr.arpa. 300 IN PTR ns.example.",
+		"2.0.17.172.in-addr.arpa. 300 IN PTR web.example.",
+	))
+}
+
+func TestNextSerial(t *testing.T) {
+	now := uint32(time.Now().Unix())
+	if serial := nextSerial(0); serial < now {
+		t.Errorf("expected a serial based on the time, got %d", serial)
+	}
+	future := now + 1000
+	if serial := nextSerial(future); serial != future+1 {
+		t.Errorf("expected the serial to never go backwards, got %d after %d", serial, future)
+	}
+}
+
+func TestSerialOnlyChangesWithRecords(t *testing.T) {
+	config := &Config{TTL: 300, SOAMbox: "hostmaster"}
+	db := newTestDB(t)
+	d := NewDNSProvider(config)
+	v1 := mustRRs(t, "web.example. 300 IN A 10.0.0.2")
+	v2 := mustRRs(t, "web.example. 300 IN A 10.0.0.3")
+
+	first := NewZoneHandler(config, db, nil).buildZone("example", "example", v1, d)
+	serial := first.SOA.(*dns.SOA).Serial
+
+	// The serial survives a restart and stays the same for the same records.
+	z := NewZoneHandler(config, db, nil)
+	if again := z.buildZone("example", "example", v1, d); again.Changed || again.SOA.(*dns.SOA).Serial != serial {
+		t.Fatalf("expected serial %d to be kept, got %d", serial, again.SOA.(*dns.SOA).Serial)
+	}
+	changed := z.buildZone("example", "example", v2, d)
+	if !changed.Changed || changed.SOA.(*dns.SOA).Serial <= serial {
+		t.Fatalf("expected a higher serial than %d, got %d", serial, changed.SOA.(*dns.SOA).Serial)
+	}
+	// Going back to the old records is a change as well.
+	if back := z.buildZone("example", "example", v1, d); back.SOA.(*dns.SOA).Serial <= changed.SOA.(*dns.SOA).Serial {
+		t.Fatalf("expected the serial to keep increasing")
+	}
+}
+
+type failingSink struct {
+	fail    bool
+	removed []string
+}
+
+func (f *failingSink) Name() string {
+	return "failing"
+}
+
+func (f *failingSink) Write(set *RecordSet) error {
+	f.removed = set.Removed
+	if f.fail {
+		return fmt.Errorf("failed")
+	}
+	return nil
+}
+
+func TestRemovedZonesAreRetried(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{TTL: 300, Domains: []string{"example"}, ZoneDir: dir}
+	db := newTestDB(t)
+	failing := &failingSink{}
+	z := NewZoneHandler(config, db, []Sink{NewZoneFileSink(config), failing})
+	d := NewDNSProvider(config)
+
+	// Zone files without a zone, like the ones of older versions, are removed.
+	stale := filepath.Join(dir, "db.old")
+	if err := os.WriteFile(stale, []byte("; old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := &docker.APIContainers{ID: "web-id", Names: []string{"/web"}}
+	c.Networks.Networks = map[string]docker.ContainerNetwork{"bridge": {IPAddress: "172.17.0.2"}}
+	z.Update(&[]Service{*NewService(c, "start", config)}, d)
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed: %v", stale, err)
+	}
+	serial := db.ZoneState("example").Serial
+
+	// The zone stays until every sink removed it.
+	failing.fail = true
+	z.Update(&[]Service{}, d)
+	z.Update(&[]Service{}, d)
+	if !funk.ContainsString(failing.removed, "example") || db.ZoneState("example").Hash == "" {
+		t.Fatalf("expected the removal to be retried, removed %v", failing.removed)
+	}
+	failing.fail = false
+	z.Update(&[]Service{}, d)
+	if state := db.ZoneState("example"); state.Hash != "" || state.Serial != serial {
+		t.Fatalf("expected the zone to be forgotten with serial %d, got %+v", serial, state)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "db.example")); !os.IsNotExist(err) {
+		t.Fatalf("expected the zone file to be removed: %v", err)
+	}
+	z.Update(&[]Service{}, d)
+	if len(failing.removed) != 0 {
+		t.Fatalf("expected no more removals, got %v", failing.removed)
+	}
+}
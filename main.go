@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/ad-on-is/coredock/internal"
 )
 
@@ -12,6 +16,35 @@ var (
 func main() {
 	config := internal.NewConfig()
 
+	if len(os.Args) > 2 && os.Args[1] == "labels" && os.Args[2] == "validate" {
+		if len(os.Args) != 4 {
+			fmt.Println("Usage: coredock labels validate <compose file>")
+			os.Exit(2)
+		}
+		problems, err := internal.ValidateComposeFile(os.Args[3])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			fmt.Printf("%d problem(s) found\n", len(problems))
+			os.Exit(1)
+		}
+		fmt.Println("All coredock labels are valid")
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "corefile" {
+		if err := internal.WriteCorefiles(config); err != nil {
+			logger.Errorf("Error writing Corefiles: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger.Infof(`
 =================================
                    _         _
@@ -25,9 +58,10 @@ Version: %s
 Domains: %v
 IP-Prefixes: %v
 Networks: %v
+Outputs: %v
 =================================
-		`, Version, config.Domains, config.IPPrefixes, config.Networks)
-	err := internal.CreateZoneDir()
+		`, Version, config.Domains, config.IPPrefixes, config.Networks, config.Outputs)
+	err := internal.CreateZoneDir(config)
 	if err != nil {
 		logger.Errorf("Error initializing zone files: %s", err)
 		panic(1)
@@ -35,14 +69,37 @@ Networks: %v
 
 	internal.InitLogger()
 	serviceChan := make(chan *[]internal.Service)
-	db := internal.NewDB()
+	db, err := internal.NewDB(config)
+	if err != nil {
+		logger.Errorf("Error opening database: %s", err)
+		panic(1)
+	}
 	d, err := internal.NewDockerClient(serviceChan, config, db)
 	if err != nil {
 		panic(err)
 	}
-	zone := internal.NewZoneHandler(config)
+	sinks := internal.NewSinks(config, db)
+	if updater := internal.NewDynamicUpdater(config, db); updater != nil {
+		sinks = append(sinks, updater)
+		go updater.Run()
+	}
+	transfer := internal.NewTransferServer(config)
+	if transfer != nil {
+		sinks = append(sinks, transfer)
+	}
+	zone := internal.NewZoneHandler(config, db, sinks)
 	dns := internal.NewDNSProvider(config)
 
+	if transfer != nil {
+		go func() {
+			err := transfer.Run()
+			if err != nil {
+				logger.Errorf("Error running zone transfer server: %s", err)
+				panic(1)
+			}
+		}()
+	}
+
 	go func() {
 		err := d.Run()
 		if err != nil {
@@ -51,7 +108,32 @@ Networks: %v
 		}
 	}()
 
-	for s := range serviceChan {
-		zone.Update(s, dns)
+	// Signatures expire, so signed zones are built again even if nothing changed.
+	var resign <-chan time.Time
+	if interval := zone.ResignInterval(); interval > 0 {
+		resign = time.NewTicker(interval).C
+	}
+
+	// Static snippets don't trigger Docker events, so they are checked for changes.
+	var static <-chan time.Time
+	if interval := zone.StaticPollInterval(); interval > 0 {
+		static = time.NewTicker(interval).C
+	}
+
+	var services *[]internal.Service
+	for {
+		select {
+		case services = <-serviceChan:
+			zone.Update(services, dns)
+		case <-resign:
+			if services != nil {
+				zone.Update(services, dns)
+			}
+		case <-static:
+			if services != nil && zone.StaticChanged() {
+				logger.Infof("Static records changed")
+				zone.Update(services, dns)
+			}
+		}
 	}
 }